@@ -1,13 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/clr1107/dnsfsd/pkg/data/cache"
 	"github.com/clr1107/dnsfsd/pkg/data/config"
 	"os"
 	"os/signal"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/clr1107/dnsfsd/daemon/logger"
 	"github.com/clr1107/dnsfsd/daemon/server"
@@ -19,14 +22,54 @@ var (
 	log *logger.Logger = &logger.Logger{}
 )
 
+const rulesDirectory string = "/etc/dnsfsd/rules"
+
 func loadRules() (*rules.RuleSet, error) {
-	files, err := rules.LoadAllRuleFiles("/etc/dnsfsd/rules")
+	mode := rules.LoadLenient
+	if viper.GetBool("rules.strict") {
+		mode = rules.LoadStrict
+	}
+
+	files, err := rules.LoadAllRuleFiles(rulesDirectory, mode)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return rules.CollectAllRules(files), nil
+	for _, v := range *files {
+		if l := len(*v.Diagnostics); l > 0 {
+			log.Log("skipped %v lines of %v rule file %v", l, v.Format, v.Path)
+
+			if viper.GetBool("log.verbose") {
+				for _, d := range *v.Diagnostics {
+					log.Log("[skipped] %v", d)
+				}
+			}
+		}
+	}
+
+	set := rules.CollectAllRules(files)
+
+	if viper.GetBool("server.parallel_match") {
+		set.SetParallel(runtime.NumCPU())
+	}
+
+	return set, nil
+}
+
+func logCacheStats(handler *server.DNSFSHandler) {
+	dnsStats, sinkStats := handler.CacheStats()
+	log.Log("dns cache: %v", dnsStats)
+	log.Log("sink cache: %v", sinkStats)
+}
+
+// spawnStatsRoutine logs the stats of the caches every interval.
+func spawnStatsRoutine(handler *server.DNSFSHandler, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			logCacheStats(handler)
+		}
+	}()
 }
 
 func spawnSignalRoutine(srv *server.DNSFSServer) {
@@ -36,6 +79,7 @@ func spawnSignalRoutine(srv *server.DNSFSServer) {
 	go func() {
 		<-signalChannel
 		log.Log("interrupt signal; shutting down...")
+		logCacheStats(srv.Handler)
 
 		if err := srv.Shutdown(); err != nil {
 			log.LogFatal("signal listener shutting down: %v", err)
@@ -57,7 +101,7 @@ func main() {
 	port := viper.GetInt("server.port")
 	forwards := viper.GetStringSlice("dns.forwards")
 	verbose := viper.GetBool("log.verbose")
-	cacheTTL := config.GetCacheTime()
+	cacheMin, cacheMax, cacheNegative := config.GetCacheMinTime(), config.GetCacheTime(), config.GetCacheNegativeTime()
 
 	if err := log.Init(logPath); err != nil {
 		fmt.Printf("main() init loggers: %v\n", err)
@@ -68,28 +112,109 @@ func main() {
 	if err != nil {
 		log.LogFatal("main() loading rules: %v", err)
 	} else {
-		log.Log("loaded %v rules", loadedRules.Size())
+		log.Log("loaded %v rules and %v local records", loadedRules.Size(), len(loadedRules.Records()))
 	}
 
-	dnsCache, err := cache.DNSCacheFromFile(cacheTTL, "/etc/dnsfsd/dns.cache")
-	if err != nil {
-		log.LogErr("could not load dns cache file, creating new DNSCache")
-		dnsCache = cache.NewDNSCache(cacheTTL)
+	dnsCache := cache.NewDNSCache(cacheMin, cacheMax, cacheNegative, viper.GetInt("dns.cache_entries"), viper.GetInt64("dns.cache_bytes"))
+	dnsCache.Stale = config.GetCacheStaleTime()
+	if err := dnsCache.LoadFromFile("/etc/dnsfsd/dns.cache"); err != nil {
+		log.LogErr("could not load dns cache file, starting with an empty cache")
 	} else {
 		log.Log("loaded %v requests from the disk cache", dnsCache.Size())
 	}
 
-	srv := server.NewServer(port, server.NewHandler(loadedRules, dnsCache, forwards, verbose, log))
+	sinkCache := cache.NewLRUCache(-1, viper.GetInt("sink.cache_entries"), viper.GetInt64("sink.cache_bytes"))
+
+	upstreams := make([]server.Upstream, 0, len(forwards))
+
+	for _, v := range forwards {
+		upstream, err := server.NewUpstream(v)
+
+		if err != nil {
+			log.LogFatal("main() parsing dns.forwards: %v", err)
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	sink, err := server.NewSinkConfig(
+		viper.GetString("sink.mode"),
+		viper.GetInt("sink.ttl"),
+		viper.GetStringSlice("sink.ipv4"),
+		viper.GetStringSlice("sink.ipv6"),
+	)
+
+	if err != nil {
+		log.LogFatal("main() parsing sink config: %v", err)
+	}
+
+	srv := server.NewServer(port, server.NewHandler(loadedRules, dnsCache, sinkCache, upstreams, sink, verbose, log))
+
+	if viper.GetBool("server.tls.enabled") {
+		tlsPort := viper.GetInt("server.tls.port")
+		tlsConfig, err := server.LoadTLSConfig(viper.GetString("server.tls.cert"), viper.GetString("server.tls.key"))
+
+		if err != nil {
+			log.LogFatal("main() loading tls config: %v", err)
+		}
+
+		srv.AddTLSListener(tlsPort, tlsConfig)
+		log.Log("dns-over-tls enabled on port %v", tlsPort)
+	}
+
+	if viper.GetBool("server.https.enabled") {
+		var httpsConfig *tls.Config
+		httpsAddr := viper.GetString("server.https.address")
+		httpsPath := viper.GetString("server.https.path")
+
+		if !viper.GetBool("server.https.plain") {
+			httpsConfig, err = server.LoadTLSConfig(viper.GetString("server.https.cert"), viper.GetString("server.https.key"))
+
+			if err != nil {
+				log.LogFatal("main() loading https tls config: %v", err)
+			}
+		}
+
+		srv.AddHTTPSListener(httpsAddr, httpsPath, httpsConfig)
+		log.Log("dns-over-https enabled on %v%v (tls: %v)", httpsAddr, httpsPath, httpsConfig != nil)
+	}
+
 	spawnSignalRoutine(srv)
 
+	if interval := viper.GetDuration("log.stats_interval"); interval > 0 {
+		spawnStatsRoutine(srv.Handler, interval)
+	}
+
+	reload := &reloader{handler: srv.Handler}
+	spawnReloadRoutine(reload)
+
+	if viper.GetBool("rules.watch") {
+		if err := spawnWatchRoutine(reload, rulesDirectory); err != nil {
+			log.LogErr("could not watch %v for changes: %v", rulesDirectory, err)
+		} else {
+			log.Log("watching %v for changes", rulesDirectory)
+		}
+	}
+
+	subscriptions, err := loadSubscriptions()
+	if err != nil {
+		log.LogFatal("main() parsing subscriptions: %v", err)
+	}
+
+	spawnSubscriptionRoutines(reload, subscriptions, rulesDirectory)
+
+	if len(subscriptions) > 0 {
+		log.Log("keeping %v subscribed rule lists up to date", len(subscriptions))
+	}
+
 	go func() {
 		for err := range srv.Handler.ErrorChannel {
 			log.LogErr("server error listener: %v", err)
 		}
 	}()
 
-	log.Log("starting listening on port %v with %v servers (verbose: %v)", port, len(forwards), verbose)
-	if err := srv.Server.ListenAndServe(); err != nil {
+	log.Log("starting listening on port %v (udp & tcp) with %v servers (verbose: %v)", port, len(forwards), verbose)
+	if err := srv.ListenAndServe(); err != nil {
 		log.LogFatal("main() starting server: %v", err)
 	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/clr1107/dnsfsd/daemon/server"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay is how long the rules directory must be quiet before changes to
+// it trigger a reload, so a file being written is only loaded once.
+const reloadDelay time.Duration = time.Second
+
+// reloader rebuilds the ruleset from the rules directory and swaps it into the
+// handler. Reloads never overlap, and one that fails keeps the old ruleset.
+type reloader struct {
+	handler *server.DNSFSHandler
+	lock    sync.Mutex
+}
+
+func (r *reloader) reload(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	loadedRules, err := loadRules()
+
+	if err != nil {
+		log.LogErr("reloading rules (%v): %v; keeping the old ruleset", reason, err)
+		return
+	}
+
+	r.handler.SetRules(loadedRules)
+	log.Log("reloaded %v rules (%v)", loadedRules.Size(), reason)
+}
+
+// spawnReloadRoutine reloads the rules whenever a SIGHUP is received.
+func spawnReloadRoutine(r *reloader) {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGHUP)
+
+	go func() {
+		for range signalChannel {
+			r.reload("SIGHUP")
+		}
+	}()
+}
+
+// spawnWatchRoutine reloads the rules whenever files in the rules directory
+// change.
+func spawnWatchRoutine(r *reloader, directory string) error {
+	watcher, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(directory); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	go func() {
+		var timer *time.Timer
+
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if timer != nil {
+					timer.Stop()
+				}
+
+				timer = time.AfterFunc(reloadDelay, func() {
+					r.reload("rules directory changed")
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				log.LogErr("watching rules directory: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohContentType string = "application/dns-message"
+
+const (
+	// dohReadTimeout and dohIdleTimeout bound DoH connections as dns.Server
+	// bounds TCP ones, so slow or idle clients cannot hold them open.
+	dohReadTimeout time.Duration = 2 * time.Second
+	dohIdleTimeout time.Duration = 8 * time.Second
+	// dohWriteTimeout also covers resolving the query, which may wait on an
+	// upstream.
+	dohWriteTimeout time.Duration = dohReadTimeout + upstreamTimeout
+)
+
+// dohResponseWriter is a dns.ResponseWriter that holds on to the reply for a
+// DNS-over-HTTPS query so that it can be sent back as the HTTP response.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
+
+// DoHHandler is an http.Handler that accepts RFC 8484 DNS-over-HTTPS queries,
+// both GET (`?dns=`) and POST (`application/dns-message`), and answers them
+// with a dns.Handler.
+type DoHHandler struct {
+	Handler dns.Handler
+}
+
+func (h *DoHHandler) readQuery(r *http.Request) ([]byte, int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+
+		if param == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("missing `dns` query parameter")
+		}
+
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("`dns` query parameter is not base64url: %v", err)
+		}
+
+		return b, 0, nil
+	case http.MethodPost:
+		// parameters, such as a charset, and the case of the media type do
+		// not matter
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != dohContentType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be %v", dohContentType)
+		}
+
+		b, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, dns.MaxMsgSize))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		return b, 0, nil
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", r.Method)
+	}
+}
+
+// minTTL returns the lowest TTL of all records in a reply, for use as the
+// HTTP freshness lifetime as suggested by RFC 8484 section 5.1.
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
+
+func (h *DoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, status, err := h.readQuery(r)
+
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	query := new(dns.Msg)
+	if err := query.Unpack(b); err != nil || len(query.Question) == 0 {
+		http.Error(w, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		rw.local = addr
+	}
+
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		rw.remote = addr
+	}
+
+	h.Handler.ServeDNS(rw, query)
+
+	reply := rw.msg
+	if reply == nil {
+		reply = new(dns.Msg).SetRcode(query, dns.RcodeServerFailure)
+	}
+
+	packed, err := reply.Pack()
+	if err != nil {
+		http.Error(w, "could not pack dns reply", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+
+	if ttl, ok := minTTL(reply); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%v", ttl))
+	}
+
+	_, _ = w.Write(packed)
+}
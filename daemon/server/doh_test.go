@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func unpackDoHReply(t *testing.T, resp *http.Response) *dns.Msg {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status code %v, expected 200", resp.StatusCode)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+		t.Fatalf("content type '%v', expected '%v'", ct, dohContentType)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		t.Fatalf("unpacking reply: %v", err)
+	}
+
+	return m
+}
+
+func TestDoHGet(t *testing.T) {
+	ts := httptest.NewServer(&DoHHandler{newTestHandler(t, "e;;blocked.test")})
+	defer ts.Close()
+
+	query := new(dns.Msg).SetQuestion("blocked.test.", dns.TypeA)
+	query.Id = 0
+	packed, _ := query.Pack()
+
+	resp, err := http.Get(ts.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(packed))
+	if err != nil {
+		t.Fatalf("GET request: %v", err)
+	}
+
+	reply := unpackDoHReply(t, resp)
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0 || !reply.Response {
+		t.Fatalf("unexpected sink reply: %v", reply)
+	}
+}
+
+func TestDoHPost(t *testing.T) {
+	ts := httptest.NewServer(&DoHHandler{newTestHandler(t, "e;;blocked.test")})
+	defer ts.Close()
+
+	query := new(dns.Msg).SetQuestion("blocked.test.", dns.TypeAAAA)
+	packed, _ := query.Pack()
+
+	for _, contentType := range []string{dohContentType, dohContentType + "; charset=utf-8", "Application/DNS-Message"} {
+		resp, err := http.Post(ts.URL+"/dns-query", contentType, bytes.NewReader(packed))
+		if err != nil {
+			t.Fatalf("POST request with content type '%v': %v", contentType, err)
+		}
+
+		reply := unpackDoHReply(t, resp)
+		if reply.Id != query.Id || reply.Question[0].Qtype != dns.TypeAAAA {
+			t.Fatalf("reply to POST request with content type '%v' does not match query: %v", contentType, reply)
+		}
+	}
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	ts := httptest.NewServer(&DoHHandler{newTestHandler(t)})
+	defer ts.Close()
+
+	cases := []struct {
+		method      string
+		url         string
+		contentType string
+		body        []byte
+		expected    int
+	}{
+		{http.MethodGet, "/dns-query", "", nil, http.StatusBadRequest},
+		{http.MethodGet, "/dns-query?dns=!!!", "", nil, http.StatusBadRequest},
+		{http.MethodGet, "/dns-query?dns=AAAA", "", nil, http.StatusBadRequest},
+		{http.MethodPost, "/dns-query", "text/plain", []byte("hello"), http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/dns-query", "application/dns-message; charset", []byte("hello"), http.StatusUnsupportedMediaType},
+		{http.MethodPut, "/dns-query", dohContentType, nil, http.StatusMethodNotAllowed},
+	}
+
+	for _, v := range cases {
+		req, _ := http.NewRequest(v.method, ts.URL+v.url, bytes.NewReader(v.body))
+		if v.contentType != "" {
+			req.Header.Set("Content-Type", v.contentType)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v: %v", v.method, v.url, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != v.expected {
+			t.Fatalf("%v %v gave status %v, expected %v", v.method, v.url, resp.StatusCode, v.expected)
+		}
+	}
+}
+
+func TestHTTPSListener(t *testing.T) {
+	srv := NewServer(0, newTestHandler(t, "e;;blocked.test"))
+	srv.AddHTTPSListener("127.0.0.1:0", "/custom-path", nil)
+
+	ts := httptest.NewServer(srv.HTTP.Handler)
+	defer ts.Close()
+
+	query := new(dns.Msg).SetQuestion("blocked.test.", dns.TypeA)
+	packed, _ := query.Pack()
+
+	resp, err := http.Post(ts.URL+"/custom-path", dohContentType, bytes.NewReader(packed))
+	if err != nil {
+		t.Fatalf("POST request: %v", err)
+	}
+	unpackDoHReply(t, resp)
+
+	resp, err = http.Post(ts.URL+"/dns-query", dohContentType, bytes.NewReader(packed))
+	if err != nil {
+		t.Fatalf("POST request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %v for unconfigured path, expected 404", resp.StatusCode)
+	}
+}
+
+func TestHTTPSListenerTimeout(t *testing.T) {
+	srv := NewServer(0, newTestHandler(t))
+	srv.AddHTTPSListener("127.0.0.1:0", "/dns-query", nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	go func() {
+		_ = srv.HTTP.Serve(ln)
+	}()
+	defer srv.HTTP.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+
+	// a client that never finishes its request headers
+	if _, err := conn.Write([]byte("POST /dns-query HTTP/1.1\r\nHost: test\r\n")); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(dohReadTimeout + 3*time.Second))
+
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("slow client was not disconnected: %v", err)
+	}
+}
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/clr1107/dnsfsd/pkg/data/cache"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/clr1107/dnsfsd/daemon/logger"
 	"github.com/clr1107/dnsfsd/pkg/rules"
@@ -32,88 +39,352 @@ func formatDomain(domain string) string {
 	return domain
 }
 
+// replySize returns the largest reply a client can receive over the transport
+// its query arrived on: the EDNS0 buffer size (or 512 bytes) for UDP, and the
+// maximum message size for TCP.
+func replySize(w dns.ResponseWriter, r *dns.Msg) int {
+	if _, ok := w.LocalAddr().(*net.UDPAddr); !ok {
+		return dns.MaxMsgSize
+	}
+
+	if opt := r.IsEdns0(); opt != nil {
+		return int(opt.UDPSize())
+	}
+
+	return dns.MinMsgSize
+}
+
+// LoadTLSConfig creates a tls.Config for serving from a PEM encoded
+// certificate and private key.
+func LoadTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not load tls certificate '%v' and key '%v': %v", certFile, keyFile, err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// DNSFSServer runs a UDP and a TCP listener on the same port, and optionally a
+// DNS-over-TLS listener and a DNS-over-HTTPS server, all served by the same
+// DNSFSHandler. They are started and stopped together.
 type DNSFSServer struct {
 	Port    int
-	Server  *dns.Server
+	Servers []*dns.Server
+	HTTP    *http.Server
 	Handler *DNSFSHandler
 }
 
 func NewServer(port int, handler *DNSFSHandler) *DNSFSServer {
-	s := &DNSFSServer{Port: port}
+	s := &DNSFSServer{Port: port, Handler: handler}
+	addr := ":" + strconv.Itoa(s.Port)
 
-	s.Server = &dns.Server{Addr: ":" + strconv.Itoa(s.Port), Net: "udp"}
-	s.Server.Handler = handler
-	s.Handler = handler
+	for _, network := range []string{"udp", "tcp"} {
+		s.Servers = append(s.Servers, &dns.Server{Addr: addr, Net: network, Handler: handler})
+	}
 
 	return s
 }
 
+// AddTLSListener adds a DNS-over-TLS (RFC 7858) listener on the given port.
+func (s *DNSFSServer) AddTLSListener(port int, config *tls.Config) {
+	s.Servers = append(s.Servers, &dns.Server{
+		Addr:      ":" + strconv.Itoa(port),
+		Net:       "tcp-tls",
+		TLSConfig: config,
+		Handler:   s.Handler,
+	})
+}
+
+// AddHTTPSListener adds a DNS-over-HTTPS (RFC 8484) server listening on addr
+// and answering queries at path. If config is nil the server speaks plain HTTP,
+// for use behind a reverse proxy that terminates TLS.
+func (s *DNSFSServer) AddHTTPSListener(addr string, path string, config *tls.Config) {
+	mux := http.NewServeMux()
+	mux.Handle(path, &DoHHandler{s.Handler})
+
+	s.HTTP = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         config,
+		ReadHeaderTimeout: dohReadTimeout,
+		ReadTimeout:       dohReadTimeout,
+		WriteTimeout:      dohWriteTimeout,
+		IdleTimeout:       dohIdleTimeout,
+	}
+}
+
+func (s *DNSFSServer) listenAndServeHTTP() error {
+	var err error
+
+	if s.HTTP.TLSConfig != nil {
+		err = s.HTTP.ListenAndServeTLS("", "")
+	} else {
+		err = s.HTTP.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// ListenAndServe starts every listener and blocks until they have all stopped.
+// The first error returned by a listener is returned.
+func (s *DNSFSServer) ListenAndServe() error {
+	count := len(s.Servers)
+	errs := make(chan error, count+1)
+
+	for _, v := range s.Servers {
+		go func(srv *dns.Server) {
+			errs <- srv.ListenAndServe()
+		}(v)
+	}
+
+	if s.HTTP != nil {
+		count++
+
+		go func() {
+			errs <- s.listenAndServeHTTP()
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (s *DNSFSServer) Shutdown() error {
+	var err error
+
+	for _, v := range s.Servers {
+		if e := v.Shutdown(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if s.HTTP != nil {
+		if e := s.HTTP.Shutdown(context.Background()); e != nil && err == nil {
+			err = e
+		}
+	}
+
 	s.Handler.sinkCache.Clear()
 	s.Handler.dnsCache.Clean()
 
-	if err := s.Handler.dnsCache.SerialiseToFile("/etc/dnsfsd/dns.cache"); err != nil {
-		return err
+	if e := s.Handler.dnsCache.SerialiseToFile("/etc/dnsfsd/dns.cache"); e != nil && err == nil {
+		err = e
 	}
 
 	close(s.Handler.ErrorChannel)
-	return s.Server.Shutdown()
+	return err
 }
 
+const (
+	// staleTTL is the TTL, in seconds, of stale answers served when no upstream
+	// answers, as RFC 8767 recommends.
+	staleTTL = 30
+	// refreshDelay is how long a background refresh of a stale answer waits
+	// before it first retries the upstreams; the delay doubles up to
+	// maxRefreshDelay.
+	refreshDelay    = time.Second
+	maxRefreshDelay = time.Minute
+)
+
 type DNSFSHandler struct {
-	rules        *rules.RuleSet
-	sinkCache    *cache.SimpleCache
+	rules        atomic.Value // *rules.RuleSet
+	sinkCache    *cache.LRUCache
 	dnsCache     *cache.DNSCache
-	forwards     []string
+	forwards     []Upstream
+	sink         SinkConfig
 	ErrorChannel chan error
 	verbose      bool
 	logger       *logger.Logger
+	refreshing   map[cache.DNSKey]bool
+	refreshLock  sync.Mutex
 }
 
-func NewHandler(rules *rules.RuleSet, dnsCache *cache.DNSCache, forwards []string, verbose bool, logger *logger.Logger) *DNSFSHandler {
-	return &DNSFSHandler{
-		rules,
-		cache.NewSimpleCache(-1),
-		dnsCache,
-		forwards,
-		make(chan error),
-		verbose,
-		logger,
+// NewHandler creates a DNSFSHandler. The sink cache holds the verdicts of the
+// rules for each query; its entries need not expire, as it is cleared whenever
+// the rules change.
+func NewHandler(rules *rules.RuleSet, dnsCache *cache.DNSCache, sinkCache *cache.LRUCache, forwards []Upstream, sink SinkConfig, verbose bool, logger *logger.Logger) *DNSFSHandler {
+	h := &DNSFSHandler{
+		sinkCache:    sinkCache,
+		dnsCache:     dnsCache,
+		forwards:     forwards,
+		sink:         sink,
+		ErrorChannel: make(chan error),
+		verbose:      verbose,
+		logger:       logger,
+		refreshing:   make(map[cache.DNSKey]bool),
 	}
+
+	h.rules.Store(rules)
+	return h
 }
 
-// returns whether to sink or not based on cache and rule matching
-func (h *DNSFSHandler) check(domain string) bool {
-	if h.sinkCache.Contains(domain) {
-		if val, ok := h.sinkCache.Get(domain).(bool); ok {
-			return val
-		}
+// Rules returns the ruleset queries are currently checked against.
+func (h *DNSFSHandler) Rules() *rules.RuleSet {
+	return h.rules.Load().(*rules.RuleSet)
+}
 
-		h.sinkCache.Remove(domain) // for some reason not a bool?
+// SetRules atomically swaps the ruleset queries are checked against, and clears
+// the sink cache of the verdicts from the old ruleset. Verdicts cached by
+// queries that raced with the swap are tagged with the old ruleset, and ignored.
+func (h *DNSFSHandler) SetRules(set *rules.RuleSet) {
+	h.rules.Store(set)
+	h.sinkCache.Clear()
+}
+
+// CacheStats returns the stats of the DNS cache and the sink cache.
+func (h *DNSFSHandler) CacheStats() (dnsStats cache.Stats, sinkStats cache.Stats) {
+	return h.dnsCache.Stats(), h.sinkCache.Stats()
+}
+
+// sinkVerdict is the value stored in the sink cache. rule is the rule that
+// sinks the domain, or nil if it should be forwarded, and set is the ruleset
+// the verdict was reached with.
+type sinkVerdict struct {
+	rule rules.IRule
+	set  *rules.RuleSet
+}
+
+// sinkKey is the sink cache key for a query, as rules may be limited to query
+// types.
+func sinkKey(domain string, qtype uint16) string {
+	return domain + " " + strconv.Itoa(int(qtype))
+}
+
+// returns the rule to sink with, or nil to forward, based on cache and rule
+// matching
+func (h *DNSFSHandler) check(domain string, qtype uint16) rules.IRule {
+	key := sinkKey(domain, qtype)
+
+	set := h.Rules()
+
+	// a verdict from a ruleset that was swapped out is ignored, even if it
+	// was cached after the sink cache was cleared
+	if val, ok := h.sinkCache.Get(key).(sinkVerdict); ok && val.set == set {
+		return val.rule
 	}
 
-	if h.rules.Test(domain) {
-		h.sinkCache.PutDefault(domain, true)
-		return true
+	rule := set.MatchQuery(domain, qtype)
+	h.sinkCache.PutDefault(key, sinkVerdict{rule, set})
+
+	return rule
+}
+
+// local creates the reply to an A or AAAA query for a domain with local
+// records, from a hosts file, or returns nil if the query is not for one. A
+// domain with records of only the other address family gets an empty reply.
+func (h *DNSFSHandler) local(r *dns.Msg, domain string) *dns.Msg {
+	question := r.Question[0]
+
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return nil
+	}
+
+	records := h.Rules().Lookup(domain)
+	if len(records) == 0 {
+		return nil
+	}
+
+	ips := make([]net.IP, 0, len(records))
+
+	for _, v := range records {
+		if (v.To4() != nil) == (question.Qtype == dns.TypeA) {
+			ips = append(ips, v)
+		}
+	}
+
+	return newMsgReply(r, h.sink.addresses(question, ips))
+}
+
+// cachedReply makes a cached response the reply to a query. The cached
+// response may have been to a query that differed in ID, in the case of its
+// name, or in whether it had an EDNS0 record, as they share a cache key.
+func cachedReply(r *dns.Msg, cached *dns.Msg) *dns.Msg {
+	cached.Id = r.Id
+	cached.Question = r.Question
+
+	if r.IsEdns0() == nil {
+		extra := cached.Extra[:0]
+
+		for _, v := range cached.Extra {
+			if _, ok := v.(*dns.OPT); !ok {
+				extra = append(extra, v)
+			}
+		}
+
+		cached.Extra = extra
 	}
 
-	h.sinkCache.PutDefault(domain, false)
-	return false
+	return cached
 }
 
 func (h *DNSFSHandler) resolve(r *dns.Msg) (*dns.Msg, error) {
 	question := r.Question[0]
+	key := cache.NewDNSKey(r)
+
+	if cached := h.dnsCache.GetResponse(key); cached != nil {
+		return cachedReply(r, cached), nil
+	}
+
+	// the upstreams failed to answer the last time, and a refresh is retrying
+	// them, so don't wait on them again
+	if h.isRefreshing(key) {
+		if stale := h.dnsCache.GetStaleResponse(key, staleTTL); stale != nil {
+			return cachedReply(r, stale), nil
+		}
+	}
 
-	if h.dnsCache.Contains(question.String()) { // todo -- cache non-string keys
-		rr, ok := h.dnsCache.Get(question.String()).([]dns.RR)
+	msg, errs := h.exchange(r)
 
-		if ok {
-			return newMsgReply(r, rr), nil
+	for _, err := range errs {
+		h.ErrorChannel <- err
+	}
+
+	if msg != nil && msg.Rcode != dns.RcodeServerFailure {
+		if !msg.Truncated {
+			h.dnsCache.PutResponse(key, msg)
+		}
+
+		return msg, nil
+	}
+
+	// serve stale (RFC 8767)
+	if stale := h.dnsCache.GetStaleResponse(key, staleTTL); stale != nil {
+		if h.verbose {
+			h.logger.Log("[stale] %v", question.String())
 		}
 
-		h.dnsCache.Remove(question.String())
+		h.refresh(r, key)
+		return cachedReply(r, stale), nil
 	}
 
+	// with nothing better, the SERVFAIL is passed on
+	if msg != nil {
+		return msg, nil
+	}
+
+	return nil, fmt.Errorf("no given DNS servers returned a result for this query: `%v`", question.String())
+}
+
+// exchange forwards a query to each upstream in turn, until one answers with
+// anything but SERVFAIL. Returns that answer, or the last SERVFAIL answer if
+// there was none, or nil if no upstream answered at all; and the errors of the
+// upstreams that failed, SERVFAIL included.
+func (h *DNSFSHandler) exchange(r *dns.Msg) (*dns.Msg, []error) {
+	question := r.Question[0]
+	errs := make([]error, 0)
+	var failed *dns.Msg
+
 	for k, v := range h.forwards {
 		if h.verbose {
 			h.logger.Log("[forwarding-%v] %v -> %v", k+1, question.String(), v)
@@ -121,25 +392,83 @@ func (h *DNSFSHandler) resolve(r *dns.Msg) (*dns.Msg, error) {
 
 		msg, err := h.forward(r, v)
 
-		if err != nil {
-			h.ErrorChannel <- err
-		} else {
-			h.dnsCache.PutDefault(question.String(), msg.Answer)
-			return msg, nil
+		if err == nil && msg.Rcode != dns.RcodeServerFailure {
+			return msg, errs
+		}
+
+		if err == nil {
+			failed = msg
+			err = fmt.Errorf("after forwarding query `%v` to '%v' the response was SERVFAIL", question.String(), v)
 		}
+
+		errs = append(errs, err)
 	}
 
-	return nil, fmt.Errorf("no given DNS servers returned a result for this query: `%v`", question.String())
+	return failed, errs
 }
 
-func (h *DNSFSHandler) forward(r *dns.Msg, dnsAddress string) (*dns.Msg, error) {
+func (h *DNSFSHandler) isRefreshing(key cache.DNSKey) bool {
+	h.refreshLock.Lock()
+	defer h.refreshLock.Unlock()
+
+	return h.refreshing[key]
+}
+
+// refresh retries a query whose stale answer was served in the background,
+// with a growing delay, until an upstream answers and the answer is cached, or
+// the stale window has passed. Only one refresh runs for each key.
+func (h *DNSFSHandler) refresh(r *dns.Msg, key cache.DNSKey) {
+	h.refreshLock.Lock()
+
+	if h.refreshing[key] {
+		h.refreshLock.Unlock()
+		return
+	}
+
+	h.refreshing[key] = true
+	h.refreshLock.Unlock()
+
+	query := r.Copy()
+	deadline := time.Now().Add(h.dnsCache.Stale)
+
+	go func() {
+		defer func() {
+			h.refreshLock.Lock()
+			delete(h.refreshing, key)
+			h.refreshLock.Unlock()
+		}()
+
+		for delay := refreshDelay; time.Now().Before(deadline); delay *= 2 {
+			if delay > maxRefreshDelay {
+				delay = maxRefreshDelay
+			}
+
+			time.Sleep(delay)
+
+			// the upstreams are known to be failing, so their errors are not
+			// reported again
+			if msg, _ := h.exchange(query); msg != nil && msg.Rcode != dns.RcodeServerFailure {
+				if !msg.Truncated {
+					h.dnsCache.PutResponse(key, msg)
+				}
+
+				if h.verbose {
+					h.logger.Log("[refreshed] %v", query.Question[0].String())
+				}
+
+				return
+			}
+		}
+	}()
+}
+
+func (h *DNSFSHandler) forward(r *dns.Msg, upstream Upstream) (*dns.Msg, error) {
 	question := r.Question[0]
-	c := new(dns.Client)
-	x, _, err := c.Exchange(r, dnsAddress)
+	x, err := upstream.Exchange(r)
 
 	if err != nil || x == nil {
 		if err == nil {
-			err = fmt.Errorf("after forwarding query `%v` to '%v' the message response was nil", question.String(), dnsAddress)
+			err = fmt.Errorf("after forwarding query `%v` to '%v' the message response was nil", question.String(), upstream)
 		}
 
 		return nil, err
@@ -152,32 +481,53 @@ func (h *DNSFSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	question := r.Question[0]
 	domain := formatDomain(question.Name)
 
-	if h.check(domain) {
-		if err := w.WriteMsg(newMsgReply(r, nil)); err != nil {
+	if m := h.local(r, domain); m != nil {
+		if err := w.WriteMsg(m); err != nil {
 			h.ErrorChannel <- err
 			return
 		}
 
 		if h.verbose {
-			h.logger.Log("[sink] %v", question.String())
+			h.logger.Log("[local] %v", question.String())
 		}
 
 		return
 	}
 
-	go func() {
-		msg, err := h.resolve(r)
+	if rule := h.check(domain, question.Qtype); rule != nil {
+		mode := rules.RuleOptions(rule).Sink
 
-		if err == nil {
-			err = w.WriteMsg(msg)
-		}
-
-		if err != nil {
+		if err := w.WriteMsg(h.sink.Reply(r, mode)); err != nil {
 			h.ErrorChannel <- err
+			return
+		}
 
-			if h.verbose {
-				h.logger.LogErr("no response sent to question (err) %v", question.String())
+		if h.verbose {
+			if mode == rules.SinkDefault {
+				mode = h.sink.Mode
 			}
+
+			source, _ := h.Rules().Source(rule)
+			h.logger.Log("[sink] %v (%v) by rule '%v' (%v)", question.String(), mode, rule, source)
 		}
-	}()
+
+		return
+	}
+
+	// each query is already served on its own goroutine; resolving here keeps
+	// the ResponseWriter valid for TCP connections.
+	msg, err := h.resolve(r)
+
+	if err == nil {
+		msg.Truncate(replySize(w, r))
+		err = w.WriteMsg(msg)
+	}
+
+	if err != nil {
+		h.ErrorChannel <- err
+
+		if h.verbose {
+			h.logger.LogErr("no response sent to question (err) %v", question.String())
+		}
+	}
 }
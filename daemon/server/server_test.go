@@ -0,0 +1,309 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clr1107/dnsfsd/daemon/logger"
+	"github.com/clr1107/dnsfsd/pkg/data/cache"
+	"github.com/clr1107/dnsfsd/pkg/rules"
+	"github.com/miekg/dns"
+)
+
+// writeSelfSignedCert generates a self-signed certificate for localhost and
+// writes it, and its key, as PEM files into dir.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+
+	certPath := path.Join(dir, "cert.pem")
+	keyPath := path.Join(dir, "key.pem")
+
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("could not write certificate: %v", err)
+	}
+
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return certPath, keyPath, pool
+}
+
+func newTestHandler(t *testing.T, lines ...string) *DNSFSHandler {
+	loaded := make([]rules.IRule, 0, len(lines))
+
+	for _, v := range lines {
+		rule, err := rules.RuleFromString(v)
+		if err != nil {
+			t.Fatalf("could not parse rule '%v': %v", v, err)
+		}
+
+		loaded = append(loaded, rule)
+	}
+
+	set := rules.CollectAllRules(&[]rules.RuleFile{{Path: "test", Loaded: true, Rules: &loaded}})
+	h := NewHandler(set, cache.NewDNSCache(0, time.Minute, time.Minute, 0, 0), cache.NewLRUCache(-1, 0, 0), nil, DefaultSinkConfig, false, &logger.Logger{})
+
+	go func() {
+		for err := range h.ErrorChannel {
+			t.Logf("handler error: %v", err)
+		}
+	}()
+
+	return h
+}
+
+// startServer starts all of the server's listeners and returns once they are
+// accepting queries.
+func startServer(t *testing.T, srv *DNSFSServer) {
+	var wg sync.WaitGroup
+	wg.Add(len(srv.Servers))
+
+	for _, v := range srv.Servers {
+		v.NotifyStartedFunc = wg.Done
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Errorf("listening: %v", err)
+		}
+	}()
+
+	wg.Wait()
+	t.Cleanup(func() {
+		for _, v := range srv.Servers {
+			_ = v.Shutdown()
+		}
+	})
+}
+
+func listenerAddr(srv *dns.Server) string {
+	if srv.PacketConn != nil {
+		return srv.PacketConn.LocalAddr().String()
+	}
+
+	return srv.Listener.Addr().String()
+}
+
+func TestTCPListener(t *testing.T) {
+	srv := NewServer(0, newTestHandler(t, "e;;blocked.test"))
+	startServer(t, srv)
+
+	for _, v := range srv.Servers {
+		c := &dns.Client{Net: v.Net}
+		m := new(dns.Msg).SetQuestion("blocked.test.", dns.TypeA)
+
+		r, _, err := c.Exchange(m, listenerAddr(v))
+		if err != nil {
+			t.Fatalf("querying over %v: %v", v.Net, err)
+		}
+
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+			t.Fatalf("unexpected sink reply over %v: %v", v.Net, r)
+		}
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	certPath, keyPath, pool := writeSelfSignedCert(t, t.TempDir())
+
+	config, err := LoadTLSConfig(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loading tls config: %v", err)
+	}
+
+	srv := NewServer(0, newTestHandler(t, "e;;blocked.test"))
+	srv.AddTLSListener(0, config)
+	startServer(t, srv)
+
+	tlsServer := srv.Servers[len(srv.Servers)-1]
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}
+	m := new(dns.Msg).SetQuestion("blocked.test.", dns.TypeA)
+
+	r, _, err := c.Exchange(m, listenerAddr(tlsServer))
+	if err != nil {
+		t.Fatalf("querying over tls: %v", err)
+	}
+
+	if r.Id != m.Id || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("unexpected sink reply over tls: %v", r)
+	}
+
+	c.TLSConfig = &tls.Config{ServerName: "localhost"}
+	if _, _, err := c.Exchange(m, listenerAddr(tlsServer)); err == nil {
+		t.Fatalf("untrusted certificate was accepted")
+	}
+}
+
+func TestLoadTLSConfigMissing(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := LoadTLSConfig(path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")); err == nil {
+		t.Fatalf("no error for missing certificate files")
+	}
+}
+
+func TestSetRules(t *testing.T) {
+	h := newTestHandler(t, "e;;blocked.test")
+
+	if h.check("blocked.test", dns.TypeA) == nil {
+		t.Fatalf("domain was not sunk by the initial ruleset")
+	}
+
+	h.SetRules(newTestHandler(t, "e;;other.test").Rules())
+
+	if h.check("blocked.test", dns.TypeA) != nil {
+		t.Fatalf("cached verdict from the old ruleset was used")
+	}
+
+	if h.check("other.test", dns.TypeA) == nil {
+		t.Fatalf("domain was not sunk by the new ruleset")
+	}
+
+	// as if a query checked against the old ruleset cached its verdict after
+	// the reload cleared the sink cache
+	old := newTestHandler(t, "e;;blocked.test").Rules()
+	h.sinkCache.PutDefault(sinkKey("blocked.test", dns.TypeA), sinkVerdict{old.MatchQuery("blocked.test", dns.TypeA), old})
+
+	if h.check("blocked.test", dns.TypeA) != nil {
+		t.Fatalf("verdict cached from an old ruleset after a reload was used")
+	}
+}
+
+func TestSetRulesRace(t *testing.T) {
+	h := newTestHandler(t)
+	sets := []*rules.RuleSet{newTestHandler(t, "e;;blocked.test").Rules(), newTestHandler(t).Rules()}
+
+	for i := 0; i < 100; i++ {
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						h.check("blocked.test", dns.TypeA)
+					}
+				}
+			}()
+		}
+
+		for j := 0; j < 10; j++ {
+			h.SetRules(sets[j%2])
+		}
+
+		h.SetRules(sets[i%2])
+		close(stop)
+		wg.Wait()
+
+		// a verdict from the other ruleset may have been cached by a query
+		// racing with the last reload, but must not be used
+		if sunk := h.check("blocked.test", dns.TypeA) != nil; sunk != (i%2 == 0) {
+			t.Fatalf("verdict from an old ruleset was used after a reload: sunk %v", sunk)
+		}
+	}
+}
+
+func TestQueryTypeRules(t *testing.T) {
+	h := newTestHandler(t, "d;qtype=AAAA|HTTPS;v6.test")
+
+	if h.check("v6.test", dns.TypeAAAA) == nil || h.check("www.v6.test", dns.TypeHTTPS) == nil {
+		t.Fatalf("query of a type the rule is limited to was not sunk")
+	}
+
+	// the cached AAAA verdict must not be used for an A query
+	if h.check("v6.test", dns.TypeA) != nil {
+		t.Fatalf("query of a type the rule is not limited to was sunk")
+	}
+
+	rw := &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, new(dns.Msg).SetQuestion("v6.test.", dns.TypeAAAA))
+
+	if rw.msg == nil || len(rw.msg.Answer) != 0 || len(rw.msg.Ns) != 1 {
+		t.Fatalf("AAAA query was not answered by the sink: %v", rw.msg)
+	}
+}
+
+func TestLocalRecords(t *testing.T) {
+	h := newTestHandler(t, "e;;nas.home")
+	h.Rules().SetRecords([]rules.Record{
+		{Domain: "nas.home", IP: net.ParseIP("10.0.0.2")},
+		{Domain: "printer.home", IP: net.ParseIP("10.0.0.3")},
+	})
+
+	cases := []struct {
+		domain  string
+		qtype   uint16
+		answers int
+	}{
+		{"nas.home.", dns.TypeA, 1},
+		{"NAS.home.", dns.TypeA, 1},
+		{"printer.home.", dns.TypeAAAA, 0},
+	}
+
+	for _, v := range cases {
+		rw := &dohResponseWriter{local: &net.TCPAddr{}}
+		h.ServeDNS(rw, new(dns.Msg).SetQuestion(v.domain, v.qtype))
+
+		if rw.msg == nil || rw.msg.Rcode != dns.RcodeSuccess || len(rw.msg.Answer) != v.answers {
+			t.Fatalf("%v %v was answered with %v, expected %v answers", v.domain, dns.TypeToString[v.qtype], rw.msg, v.answers)
+		}
+	}
+
+	rw := &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, new(dns.Msg).SetQuestion("nas.home.", dns.TypeA))
+
+	if a, ok := rw.msg.Answer[0].(*dns.A); !ok || !a.A.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("unexpected local answer %v", rw.msg.Answer[0])
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/clr1107/dnsfsd/pkg/rules"
+	"github.com/miekg/dns"
+)
+
+// SinkConfig is how sinkholed queries are answered. Mode may be overridden by
+// the rule that sinkholed a query.
+type SinkConfig struct {
+	Mode rules.SinkMode
+	TTL  uint32
+	IPv4 []net.IP // answers for A queries in custom-ip mode
+	IPv6 []net.IP // answers for AAAA queries in custom-ip mode
+}
+
+// DefaultSinkConfig answers with an empty NOERROR reply.
+var DefaultSinkConfig = SinkConfig{Mode: rules.SinkNoData, TTL: 60}
+
+// NewSinkConfig creates a SinkConfig from the textual configuration values.
+func NewSinkConfig(mode string, ttl int, ipv4 []string, ipv6 []string) (SinkConfig, error) {
+	c := SinkConfig{TTL: uint32(ttl)}
+	var err error
+
+	if c.Mode, err = rules.ParseSinkMode(mode); err != nil {
+		return c, err
+	}
+
+	if c.IPv4, err = parseIPs(ipv4, true); err != nil {
+		return c, err
+	}
+
+	if c.IPv6, err = parseIPs(ipv6, false); err != nil {
+		return c, err
+	}
+
+	if c.Mode == rules.SinkCustomIP && len(c.IPv4) == 0 && len(c.IPv6) == 0 {
+		return c, fmt.Errorf("sink mode `%v` needs at least one ipv4/ipv6 address to answer with", c.Mode)
+	}
+
+	return c, nil
+}
+
+func parseIPs(text []string, v4 bool) ([]net.IP, error) {
+	ips := make([]net.IP, 0, len(text))
+
+	for _, v := range text {
+		ip := net.ParseIP(v)
+
+		if ip == nil || (ip.To4() != nil) != v4 {
+			return nil, fmt.Errorf("'%v' is not a valid ipv4/ipv6 address for a sink answer", v)
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+// soa creates an SOA record for the authority section of a negative sink
+// reply, so clients cache the reply for the configured ttl.
+func (c *SinkConfig) soa(name string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: c.TTL},
+		Ns:      name,
+		Mbox:    "hostmaster." + name,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  c.TTL,
+	}
+}
+
+func (c *SinkConfig) addresses(question dns.Question, ips []net.IP) []dns.RR {
+	ans := make([]dns.RR, 0, len(ips))
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: c.TTL}
+
+	for _, ip := range ips {
+		if question.Qtype == dns.TypeA {
+			ans = append(ans, &dns.A{Hdr: hdr, A: ip})
+		} else {
+			ans = append(ans, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	return ans
+}
+
+// Reply creates the reply to a sinkholed query. A non-default mode, given by
+// the rule that sinkholed the query, takes the place of the configured mode.
+func (c *SinkConfig) Reply(r *dns.Msg, mode rules.SinkMode) *dns.Msg {
+	if mode == rules.SinkDefault {
+		mode = c.Mode
+	}
+
+	question := r.Question[0]
+	var ips []net.IP
+
+	switch mode {
+	case rules.SinkNXDomain:
+		m := newMsgReply(r, nil)
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{c.soa(question.Name)}
+
+		return m
+	case rules.SinkRefused:
+		m := newMsgReply(r, nil)
+		m.Rcode = dns.RcodeRefused
+
+		return m
+	case rules.SinkNullIP:
+		if question.Qtype == dns.TypeA {
+			ips = []net.IP{net.IPv4zero}
+		} else if question.Qtype == dns.TypeAAAA {
+			ips = []net.IP{net.IPv6unspecified}
+		}
+	case rules.SinkCustomIP:
+		if question.Qtype == dns.TypeA {
+			ips = c.IPv4
+		} else if question.Qtype == dns.TypeAAAA {
+			ips = c.IPv6
+		}
+	}
+
+	if len(ips) == 0 {
+		m := newMsgReply(r, nil)
+		m.Ns = []dns.RR{c.soa(question.Name)}
+
+		return m
+	}
+
+	return newMsgReply(r, c.addresses(question, ips))
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/clr1107/dnsfsd/pkg/rules"
+	"github.com/miekg/dns"
+)
+
+func TestSinkModes(t *testing.T) {
+	config, err := NewSinkConfig("nodata", 30, []string{"192.0.2.1"}, []string{"2001:db8::1"})
+	if err != nil {
+		t.Fatalf("creating sink config: %v", err)
+	}
+
+	cases := []struct {
+		mode    rules.SinkMode
+		qtype   uint16
+		rcode   int
+		answers []string
+	}{
+		{rules.SinkDefault, dns.TypeA, dns.RcodeSuccess, nil},
+		{rules.SinkNoData, dns.TypeA, dns.RcodeSuccess, nil},
+		{rules.SinkNXDomain, dns.TypeA, dns.RcodeNameError, nil},
+		{rules.SinkRefused, dns.TypeA, dns.RcodeRefused, nil},
+		{rules.SinkNullIP, dns.TypeA, dns.RcodeSuccess, []string{"0.0.0.0"}},
+		{rules.SinkNullIP, dns.TypeAAAA, dns.RcodeSuccess, []string{"::"}},
+		{rules.SinkNullIP, dns.TypeMX, dns.RcodeSuccess, nil},
+		{rules.SinkCustomIP, dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.1"}},
+		{rules.SinkCustomIP, dns.TypeAAAA, dns.RcodeSuccess, []string{"2001:db8::1"}},
+	}
+
+	for _, v := range cases {
+		r := config.Reply(new(dns.Msg).SetQuestion("blocked.test.", v.qtype), v.mode)
+
+		if r.Rcode != v.rcode || len(r.Answer) != len(v.answers) {
+			t.Fatalf("mode `%v` (%v) gave unexpected reply: %v", v.mode, dns.TypeToString[v.qtype], r)
+		}
+
+		for k, rr := range r.Answer {
+			var ip net.IP
+
+			switch x := rr.(type) {
+			case *dns.A:
+				ip = x.A
+			case *dns.AAAA:
+				ip = x.AAAA
+			}
+
+			if ip.String() != v.answers[k] || rr.Header().Ttl != 30 {
+				t.Fatalf("mode `%v` answered %v, expected %v with ttl 30", v.mode, rr, v.answers[k])
+			}
+		}
+
+		if len(v.answers) == 0 && v.rcode != dns.RcodeRefused {
+			if len(r.Ns) != 1 || r.Ns[0].(*dns.SOA).Minttl != 30 {
+				t.Fatalf("mode `%v` negative reply has no soa with the sink ttl: %v", v.mode, r)
+			}
+		}
+	}
+}
+
+func TestSinkConfigInvalid(t *testing.T) {
+	if _, err := NewSinkConfig("blackhole", 60, nil, nil); err == nil {
+		t.Fatalf("no error for unknown sink mode")
+	}
+
+	if _, err := NewSinkConfig("custom-ip", 60, []string{"2001:db8::1"}, nil); err == nil {
+		t.Fatalf("no error for ipv6 address given as ipv4")
+	}
+
+	if _, err := NewSinkConfig("custom-ip", 60, nil, []string{}); err == nil {
+		t.Fatalf("no error for custom-ip mode without addresses")
+	}
+
+	if _, err := NewSinkConfig("custom-ip", 60, nil, []string{"2001:db8::1"}); err != nil {
+		t.Fatalf("error for custom-ip mode with only an ipv6 address: %v", err)
+	}
+}
+
+func TestRuleSinkOverride(t *testing.T) {
+	h := newTestHandler(t, "e;;blocked.test", "e;sink=nxdomain;other.test")
+
+	for domain, rcode := range map[string]int{"blocked.test.": dns.RcodeSuccess, "other.test.": dns.RcodeNameError} {
+		rw := &dohResponseWriter{local: &net.TCPAddr{}}
+		h.ServeDNS(rw, new(dns.Msg).SetQuestion(domain, dns.TypeA))
+
+		if rw.msg == nil || rw.msg.Rcode != rcode {
+			t.Fatalf("%v was answered with %v, expected rcode %v", domain, rw.msg, dns.RcodeToString[rcode])
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	upstreamTimeout time.Duration = 5 * time.Second
+	maxIdleConns    int           = 8
+)
+
+// Upstream is a DNS server that queries which pass the rules are forwarded to.
+// Each implementation owns its transport and reuses connections between
+// queries where the transport allows it.
+type Upstream interface {
+	Exchange(m *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// NewUpstream creates an Upstream from a `dns.forwards` entry. Entries are
+// either a plain `host:port`, which is queried over UDP (falling back to TCP
+// for truncated answers), or a URL:
+//
+//	udp://1.1.1.1:53
+//	tcp://1.1.1.1:53
+//	tls://1.1.1.1:853#cloudflare-dns.com (the fragment is the tls server name)
+//	https://1.1.1.1/dns-query#cloudflare-dns.com (the same)
+//
+// TLS and HTTPS upstreams must be given by IP address: their names would be
+// resolved by the system resolver, which may well be this server.
+func NewUpstream(address string) (Upstream, error) {
+	if !strings.Contains(address, "://") {
+		return newPlainUpstream(address), nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse upstream '%v': %v", address, err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream '%v' has no host", address)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return newPlainUpstream(withDefaultPort(u.Host, "53")), nil
+	case "tcp":
+		return newStreamUpstream(withDefaultPort(u.Host, "53"), "tcp", nil), nil
+	case "tls":
+		if err := requireIP(u, address); err != nil {
+			return nil, err
+		}
+
+		serverName := u.Fragment
+		if serverName == "" {
+			serverName = u.Hostname()
+		}
+
+		config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+		return newStreamUpstream(withDefaultPort(u.Host, "853"), "tcp-tls", config), nil
+	case "https":
+		if err := requireIP(u, address); err != nil {
+			return nil, err
+		}
+
+		// the request goes to the name in the fragment, for the Host header and
+		// the tls server name, but the connection to the IP address
+		name, dial := u.Fragment, ""
+		u.Fragment = ""
+
+		if name != "" {
+			dial = withDefaultPort(u.Host, "443")
+
+			if port := u.Port(); port != "" {
+				name = net.JoinHostPort(name, port)
+			}
+
+			u.Host = name
+		}
+
+		return newHTTPSUpstream(u.String(), dial, &tls.Config{MinVersion: tls.VersionTLS12}), nil
+	default:
+		return nil, fmt.Errorf("upstream '%v' has unsupported scheme `%v`", address, u.Scheme)
+	}
+}
+
+// requireIP returns an error if the host of an upstream URL is not an IP
+// address.
+func requireIP(u *url.URL, address string) error {
+	if net.ParseIP(u.Hostname()) == nil {
+		return fmt.Errorf("upstream '%v' must be given by IP address, with its name as the fragment (%v://<ip>#%v)", address, u.Scheme, u.Hostname())
+	}
+
+	return nil
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// plainUpstream queries over UDP and retries over TCP when an answer is
+// truncated, so the whole answer can be passed on to the client.
+type plainUpstream struct {
+	address string
+	udp     *dns.Client
+	tcp     *dns.Client
+}
+
+func newPlainUpstream(address string) *plainUpstream {
+	return &plainUpstream{
+		address,
+		&dns.Client{Net: "udp", Timeout: upstreamTimeout},
+		&dns.Client{Net: "tcp", Timeout: upstreamTimeout},
+	}
+}
+
+func (u *plainUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	x, _, err := u.udp.Exchange(m, u.address)
+
+	if err == nil && x != nil && x.Truncated {
+		x, _, err = u.tcp.Exchange(m, u.address)
+	}
+
+	return x, err
+}
+
+func (u *plainUpstream) String() string {
+	return u.address
+}
+
+// streamUpstream queries over TCP or TLS, keeping idle connections open to be
+// reused by later queries.
+type streamUpstream struct {
+	address string
+	client  *dns.Client
+	idle    []*dns.Conn
+	lock    sync.Mutex
+}
+
+func newStreamUpstream(address string, network string, config *tls.Config) *streamUpstream {
+	return &streamUpstream{
+		address: address,
+		client:  &dns.Client{Net: network, TLSConfig: config, Timeout: upstreamTimeout},
+	}
+}
+
+// conn returns an idle connection, or dials a new one. The returned bool is
+// whether the connection was reused.
+func (u *streamUpstream) conn() (*dns.Conn, bool, error) {
+	u.lock.Lock()
+
+	if l := len(u.idle); l > 0 {
+		conn := u.idle[l-1]
+		u.idle = u.idle[:l-1]
+		u.lock.Unlock()
+
+		return conn, true, nil
+	}
+
+	u.lock.Unlock()
+
+	conn, err := u.client.Dial(u.address)
+	return conn, false, err
+}
+
+func (u *streamUpstream) release(conn *dns.Conn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if len(u.idle) >= maxIdleConns {
+		_ = conn.Close()
+		return
+	}
+
+	u.idle = append(u.idle, conn)
+}
+
+func (u *streamUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	for {
+		conn, reused, err := u.conn()
+		if err != nil {
+			return nil, err
+		}
+
+		x, _, err := u.client.ExchangeWithConn(m, conn)
+		if err == nil {
+			u.release(conn)
+			return x, nil
+		}
+
+		_ = conn.Close()
+
+		// an idle connection may have been closed by the server in the meantime,
+		// so only give up once a fresh connection has failed too
+		if !reused {
+			return nil, err
+		}
+	}
+}
+
+func (u *streamUpstream) String() string {
+	if u.client.Net == "tcp-tls" {
+		return "tls://" + u.address + "#" + u.client.TLSConfig.ServerName
+	}
+
+	return u.client.Net + "://" + u.address
+}
+
+// httpsUpstream queries over DNS-over-HTTPS (RFC 8484) using POST requests.
+// The underlying http.Transport keeps connections alive between queries.
+type httpsUpstream struct {
+	url    string
+	dial   string
+	client *http.Client
+}
+
+// newHTTPSUpstream creates an httpsUpstream. If dial is not "", connections
+// are made to that address instead of resolving the host of url.
+func newHTTPSUpstream(url string, dial string, config *tls.Config) *httpsUpstream {
+	transport := &http.Transport{
+		TLSClientConfig:     config,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if dial == "" {
+		transport.Proxy = http.ProxyFromEnvironment
+	} else {
+		dialer := &net.Dialer{Timeout: upstreamTimeout}
+
+		transport.DialContext = func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, dial)
+		}
+	}
+
+	return &httpsUpstream{url, dial, &http.Client{Transport: transport, Timeout: upstreamTimeout}}
+}
+
+func (u *httpsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 asks for an ID of 0 so responses are friendlier to HTTP caches
+	query := m.Copy()
+	query.Id = 0
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request to '%v' gave a %v status code", u.url, resp.StatusCode)
+	}
+
+	x := new(dns.Msg)
+	if err := x.Unpack(body); err != nil {
+		return nil, fmt.Errorf("could not unpack response from '%v': %v", u.url, err)
+	}
+
+	x.Id = m.Id
+	return x, nil
+}
+
+func (u *httpsUpstream) String() string {
+	if u.dial != "" {
+		return u.url + " (" + u.dial + ")"
+	}
+
+	return u.url
+}
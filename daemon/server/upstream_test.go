@@ -0,0 +1,435 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clr1107/dnsfsd/pkg/data/cache"
+	"github.com/miekg/dns"
+)
+
+// countingListener counts the connections it has accepted.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+
+	return conn, err
+}
+
+// answerHandler answers every A query with 192.0.2.1.
+var answerHandler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg).SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+
+	_ = w.WriteMsg(m)
+})
+
+func checkUpstreamAnswer(t *testing.T, u Upstream) {
+	m := new(dns.Msg).SetQuestion("example.test.", dns.TypeA)
+	r, err := u.Exchange(m)
+
+	if err != nil {
+		t.Fatalf("exchange with %v: %v", u, err)
+	}
+
+	if r.Id != m.Id || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("unexpected answer from %v: %v", u, r)
+	}
+}
+
+func TestTLSUpstream(t *testing.T) {
+	certPath, keyPath, pool := writeSelfSignedCert(t, t.TempDir())
+	config, err := LoadTLSConfig(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loading tls config: %v", err)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	counter := &countingListener{Listener: inner}
+	srv := &dns.Server{Listener: tls.NewListener(counter, config), Handler: answerHandler}
+
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	defer srv.Shutdown()
+
+	u := newStreamUpstream(inner.Addr().String(), "tcp-tls", &tls.Config{RootCAs: pool, ServerName: "localhost"})
+
+	for i := 0; i < 3; i++ {
+		checkUpstreamAnswer(t, u)
+	}
+
+	if accepted := atomic.LoadInt32(&counter.accepted); accepted != 1 {
+		t.Fatalf("%v connections were made, expected 1 to be reused", accepted)
+	}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	var connections int32
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		query := new(dns.Msg)
+
+		if err := query.Unpack(b); err != nil || query.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+
+		rw := &dohResponseWriter{}
+		answerHandler.ServeDNS(rw, query)
+		packed, _ := rw.msg.Pack()
+
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(packed)
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	u := newHTTPSUpstream(ts.URL+"/dns-query", "", &tls.Config{RootCAs: pool})
+
+	for i := 0; i < 3; i++ {
+		checkUpstreamAnswer(t, u)
+	}
+
+	if c := atomic.LoadInt32(&connections); c != 1 {
+		t.Fatalf("%v connections were made, expected 1 to be reused", c)
+	}
+
+	// by name, connecting to the IP address, as with
+	// https://127.0.0.1:<port>/dns-query#example.com; the test certificate is
+	// for example.com
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	u = newHTTPSUpstream("https://example.com:"+port+"/dns-query", ts.Listener.Addr().String(), &tls.Config{RootCAs: pool})
+
+	checkUpstreamAnswer(t, u)
+}
+
+func TestHandlerForwardsToUpstream(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	srv := &dns.Server{PacketConn: pc, Handler: answerHandler}
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	defer srv.Shutdown()
+
+	upstream, err := NewUpstream("udp://" + pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("parsing upstream: %v", err)
+	}
+
+	h := newTestHandler(t)
+	h.forwards = []Upstream{upstream}
+
+	rw := &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, new(dns.Msg).SetQuestion("example.test.", dns.TypeA))
+
+	if rw.msg == nil || len(rw.msg.Answer) != 1 {
+		t.Fatalf("query was not forwarded: %v", rw.msg)
+	}
+
+	// the answer's TTL of 300 is clamped to the test cache's maximum, 60
+	_ = srv.Shutdown()
+
+	rw = &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, new(dns.Msg).SetQuestion("example.test.", dns.TypeA))
+
+	if rw.msg == nil || len(rw.msg.Answer) != 1 || rw.msg.Answer[0].Header().Ttl > 60 {
+		t.Fatalf("query was not answered from the cache with a clamped TTL: %v", rw.msg)
+	}
+}
+
+func TestHandlerCachesNegative(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg).SetRcode(r, dns.RcodeNameError)
+		soa, _ := dns.NewRR("test. 900 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300")
+		m.Ns = append(m.Ns, soa)
+
+		_ = w.WriteMsg(m)
+	})}
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+
+	upstream, err := NewUpstream("udp://" + pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("parsing upstream: %v", err)
+	}
+
+	h := newTestHandler(t)
+	h.forwards = []Upstream{upstream}
+
+	rw := &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, new(dns.Msg).SetQuestion("missing.test.", dns.TypeA))
+
+	if rw.msg == nil || rw.msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("query was not forwarded: %v", rw.msg)
+	}
+
+	_ = srv.Shutdown()
+
+	rw = &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, new(dns.Msg).SetQuestion("missing.test.", dns.TypeA))
+
+	// the SOA minimum of 300 is capped at the test cache's negative TTL, 60
+	if rw.msg == nil || rw.msg.Rcode != dns.RcodeNameError || len(rw.msg.Ns) != 1 || rw.msg.Ns[0].Header().Ttl > 60 {
+		t.Fatalf("NXDOMAIN was not answered from the cache: %v", rw.msg)
+	}
+}
+
+func TestHandlerCacheFidelity(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg).SetReply(r)
+		m.Authoritative = true
+
+		answer, _ := dns.NewRR("example.test. 60 IN CNAME www.example.test.")
+		target, _ := dns.NewRR("www.example.test. 60 IN A 192.0.2.1")
+		ns, _ := dns.NewRR("example.test. 60 IN NS ns.example.test.")
+		glue, _ := dns.NewRR("ns.example.test. 60 IN A 192.0.2.53")
+
+		m.Answer = []dns.RR{answer, target}
+		m.Ns = []dns.RR{ns}
+		m.Extra = []dns.RR{glue}
+
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(1232, opt.Do())
+		}
+
+		_ = w.WriteMsg(m)
+	})}
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+
+	upstream, err := NewUpstream("udp://" + pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("parsing upstream: %v", err)
+	}
+
+	h := newTestHandler(t)
+	h.forwards = []Upstream{upstream}
+
+	query := new(dns.Msg).SetQuestion("example.test.", dns.TypeA)
+	query.SetEdns0(1232, false)
+
+	rw := &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, query)
+	forwarded := rw.msg
+
+	if forwarded == nil || len(forwarded.Answer) != 2 {
+		t.Fatalf("query was not forwarded: %v", forwarded)
+	}
+
+	_ = srv.Shutdown()
+
+	// the same query, but with another ID and in another case
+	again := new(dns.Msg).SetQuestion("EXAMPLE.test.", dns.TypeA)
+	again.SetEdns0(1232, false)
+
+	rw = &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, again)
+	cached := rw.msg
+
+	if cached == nil || cached.Id != again.Id || cached.Question[0].Name != "EXAMPLE.test." {
+		t.Fatalf("cached response was not made a reply to the query: %v", cached)
+	}
+
+	cached.Id, cached.Question = forwarded.Id, forwarded.Question
+
+	if cached.String() != forwarded.String() {
+		t.Fatalf("cached response was\n%v\nexpected\n%v", cached, forwarded)
+	}
+
+	// a query without EDNS0 shares the cache entry, but not the OPT record
+	rw = &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, new(dns.Msg).SetQuestion("example.test.", dns.TypeA))
+
+	if rw.msg == nil || rw.msg.IsEdns0() != nil || len(rw.msg.Extra) != 1 {
+		t.Fatalf("cached response to a query without EDNS0 was %v", rw.msg)
+	}
+}
+
+// flakyUpstream answers as answerHandler does while it is up, and fails
+// otherwise, or answers SERVFAIL if servfail is set.
+type flakyUpstream struct {
+	down     int32
+	servfail int32
+}
+
+func (u *flakyUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if atomic.LoadInt32(&u.down) != 0 {
+		return nil, errors.New("upstream is down")
+	}
+
+	if atomic.LoadInt32(&u.servfail) != 0 {
+		return new(dns.Msg).SetRcode(m, dns.RcodeServerFailure), nil
+	}
+
+	rw := &dohResponseWriter{}
+	answerHandler.ServeDNS(rw, m)
+
+	return rw.msg, nil
+}
+
+func (u *flakyUpstream) String() string {
+	return "flaky"
+}
+
+func TestHandlerServesStale(t *testing.T) {
+	upstream := &flakyUpstream{}
+
+	h := newTestHandler(t)
+	h.forwards = []Upstream{upstream}
+	h.dnsCache = cache.NewDNSCache(0, 500*time.Millisecond, 0, 0, 0)
+	h.dnsCache.Stale = time.Minute
+
+	query := new(dns.Msg).SetQuestion("example.test.", dns.TypeA)
+	key := cache.NewDNSKey(query)
+
+	rw := &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, query)
+
+	if rw.msg == nil || len(rw.msg.Answer) != 1 {
+		t.Fatalf("query was not forwarded: %v", rw.msg)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	atomic.StoreInt32(&upstream.down, 1)
+
+	rw = &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, query)
+
+	if rw.msg == nil || len(rw.msg.Answer) != 1 || rw.msg.Answer[0].Header().Ttl != staleTTL {
+		t.Fatalf("expired answer was not served stale: %v", rw.msg)
+	}
+
+	if !h.isRefreshing(key) {
+		t.Fatalf("stale answer is not being refreshed")
+	}
+
+	atomic.StoreInt32(&upstream.down, 0)
+
+	for deadline := time.Now().Add(5 * time.Second); h.isRefreshing(key); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stale answer was not refreshed once the upstream recovered")
+		}
+	}
+
+	if h.dnsCache.GetResponse(key) == nil {
+		t.Fatalf("refreshed answer was not cached")
+	}
+}
+
+func TestHandlerServFail(t *testing.T) {
+	failing := &flakyUpstream{servfail: 1}
+	upstream := &flakyUpstream{}
+
+	h := newTestHandler(t)
+	h.forwards = []Upstream{failing, upstream}
+	h.dnsCache = cache.NewDNSCache(0, 500*time.Millisecond, 0, 0, 0)
+	h.dnsCache.Stale = time.Minute
+
+	query := new(dns.Msg).SetQuestion("example.test.", dns.TypeA)
+
+	// a SERVFAIL goes on to the next upstream
+	rw := &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, query)
+
+	if rw.msg == nil || rw.msg.Rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+		t.Fatalf("query was not answered by the upstream after the one that failed: %v", rw.msg)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	atomic.StoreInt32(&upstream.servfail, 1)
+
+	// once every upstream fails, the expired answer is served stale
+	rw = &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, query)
+
+	if rw.msg == nil || rw.msg.Rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 || rw.msg.Answer[0].Header().Ttl != staleTTL {
+		t.Fatalf("expired answer was not served stale after SERVFAIL: %v", rw.msg)
+	}
+
+	// without a stale answer the SERVFAIL is passed on
+	rw = &dohResponseWriter{local: &net.TCPAddr{}}
+	h.ServeDNS(rw, new(dns.Msg).SetQuestion("other.test.", dns.TypeA))
+
+	if rw.msg == nil || rw.msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("SERVFAIL was not passed on: %v", rw.msg)
+	}
+}
+
+func TestNewUpstream(t *testing.T) {
+	cases := map[string]string{
+		"1.1.1.1:53":                                   "1.1.1.1:53",
+		"udp://1.1.1.1":                                "1.1.1.1:53",
+		"tcp://1.1.1.1":                                "tcp://1.1.1.1:53",
+		"tls://1.1.1.1:853#cloudflare-dns.com":         "tls://1.1.1.1:853#cloudflare-dns.com",
+		"tls://192.0.2.53":                             "tls://192.0.2.53:853#192.0.2.53",
+		"https://192.0.2.53/dns-query":                 "https://192.0.2.53/dns-query",
+		"https://1.1.1.1/dns-query#cloudflare-dns.com": "https://cloudflare-dns.com/dns-query (1.1.1.1:443)",
+		"https://[2001:db8::53]:8443/q#dns.example":    "https://dns.example:8443/q ([2001:db8::53]:8443)",
+	}
+
+	for in, expected := range cases {
+		u, err := NewUpstream(in)
+		if err != nil {
+			t.Fatalf("parsing '%v': %v", in, err)
+		}
+
+		if u.String() != expected {
+			t.Fatalf("'%v' was parsed as '%v', expected '%v'", in, u, expected)
+		}
+	}
+
+	for _, in := range []string{"quic://1.1.1.1", "tls://", "tls://dns.example", "https://dns.example/dns-query"} {
+		if _, err := NewUpstream(in); err == nil {
+			t.Fatalf("no error for invalid upstream '%v'", in)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/clr1107/dnsfsd/pkg/data/config"
+	"github.com/clr1107/dnsfsd/pkg/rules"
+)
+
+// subscriptionTimeout is how long downloading a subscribed list may take.
+const subscriptionTimeout time.Duration = 5 * time.Minute
+
+// loadSubscriptions creates the subscriptions from the configuration.
+func loadSubscriptions() ([]*rules.Subscription, error) {
+	configs, err := config.GetSubscriptions()
+
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]*rules.Subscription, 0, len(configs))
+
+	for _, v := range configs {
+		s, err := rules.NewSubscription(v.Name, v.URL, v.Format, v.Interval)
+
+		if err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, nil
+}
+
+// spawnSubscriptionRoutines updates each subscription straight away and then
+// every interval, reloading the rules whenever a list changes. A list that
+// fails to download or load is logged and the previous version kept.
+func spawnSubscriptionRoutines(r *reloader, subscriptions []*rules.Subscription, directory string) {
+	client := &http.Client{Timeout: subscriptionTimeout}
+
+	for _, v := range subscriptions {
+		go func(s *rules.Subscription) {
+			ticker := time.NewTicker(s.Interval)
+			defer ticker.Stop()
+
+			for {
+				if updated, err := s.Update(client, directory); err != nil {
+					log.LogErr("updating subscription: %v; keeping the previous list", err)
+				} else if updated {
+					r.reload("subscription " + s.Name + " updated")
+				}
+
+				<-ticker.C
+			}
+		}(v)
+	}
+}
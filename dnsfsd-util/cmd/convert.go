@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/clr1107/dnsfsd/pkg/rules"
+	"github.com/spf13/cobra"
+)
+
+var (
+	convertCmd = &cobra.Command{
+		Use:   "convert --from <format> [file]",
+		Short: "Convert a rule file from another blocker's format",
+		Long: `Convert a rule file from another blocker's format (adblock, hosts, dnscrypt or dnsmasq) into dnsfsd rules.
+The file is read from stdin if none is given and the rules are written to stdout. A summary of how many lines were converted, skipped or rejected, and why, is written to stderr.`,
+		RunE: runConvertSubCommand,
+	}
+
+	convertFrom string
+	convertTo   string
+)
+
+func init() {
+	convertCmd.Flags().StringVar(&convertFrom, "from", "", "format to convert from: adblock, hosts, dnscrypt or dnsmasq")
+	convertCmd.Flags().StringVar(&convertTo, "to", string(rules.FormatDNSFSD), "format to convert to, only dnsfsd")
+	convertCmd.MarkFlagRequired("from")
+}
+
+func runConvertSubCommand(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return cmd.Help()
+	}
+
+	from, err := rules.ParseFormat(convertFrom)
+	if err != nil {
+		return err
+	}
+
+	if to, err := rules.ParseFormat(convertTo); err != nil {
+		return err
+	} else if to != rules.FormatDNSFSD {
+		return fmt.Errorf("cannot convert to %v, only to dnsfsd", to)
+	}
+
+	var in io.Reader = os.Stdin
+	name := "stdin"
+
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("could not open rule file '%v'", args[0])
+		}
+		defer f.Close()
+
+		in, name = f, args[0]
+	}
+
+	summary, err := rules.Convert(in, os.Stdout, from, name)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range summary.Diagnostics {
+		fmt.Fprintf(os.Stderr, "rejected %v\n", v)
+	}
+
+	fmt.Fprintln(os.Stderr, summary)
+	return nil
+}
@@ -3,25 +3,36 @@ package cmd
 import (
 	"fmt"
 	"github.com/clr1107/dnsfsd/pkg/rules"
+	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
 	"strings"
 )
 
 var (
 	digCmd = &cobra.Command{
-		Use:   "dig <domain>",
+		Use:   "dig <domain> [type]",
 		Short: "Run a DNS query through the server",
-		Long:  `Run a DNS query (A) through the server and find out what it would do. As a form of testing.`,
+		Long:  `Run a DNS query (A, or the given type) through the server and find out what it would do. As a form of testing.`,
 		RunE:  runDigSubCommand,
 	}
 )
 
 func runDigSubCommand(cmd *cobra.Command, args []string) error {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return cmd.Help()
 	}
 
 	domain := strings.ToLower(args[0])
+	qtype := dns.TypeA
+
+	if len(args) == 2 {
+		var err error
+
+		if qtype, err = rules.ParseQueryType(args[1]); err != nil {
+			return err
+		}
+	}
+
 	files, err := loadRules()
 
 	if err != nil {
@@ -31,21 +42,31 @@ func runDigSubCommand(cmd *cobra.Command, args []string) error {
 	ruleset := rules.CollectAllRules(files)
 
 	println("; Test DNS Ruleset")
-	fmt.Printf("; checking against %v rules", ruleset.Size())
-	fmt.Printf("; (A) %v\n;\n", domain)
+	fmt.Printf("; checking against %v rules\n", ruleset.Size())
+	fmt.Printf("; (%v) %v\n;\n", dns.Type(qtype), domain)
 
-	var test bool
+	var verdict rules.Verdict
 
 	delta := timeIt(func() {
-		test = ruleset.Test(domain)
+		verdict = ruleset.ExplainQuery(domain, qtype)
 	}).Milliseconds()
 
-	if test {
+	if verdict.Sink {
 		fmt.Printf("; ruleset indicates SINK on domain %v\n", domain)
 	} else {
 		fmt.Printf("; ruleset indicates to FORWARD domain %v to DNS server(s)\n", domain)
 	}
 
+	if verdict.Rule != nil {
+		fmt.Printf(";   decided by rule '%v' (%v)\n", verdict.Rule, verdict.Source)
+	} else {
+		fmt.Println(";   no rule matched")
+	}
+
+	if verdict.Overridden != nil {
+		fmt.Printf(";   overriding blacklist rule '%v' (%v)\n", verdict.Overridden, verdict.OverriddenSource)
+	}
+
 	fmt.Printf(";\n; test took %v ms\n", delta)
 	fmt.Println("; remember, this tool does not use any caching!")
 
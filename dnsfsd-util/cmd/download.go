@@ -2,8 +2,11 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"path"
+	"strings"
 
 	"github.com/clr1107/dnsfsd/pkg/rules"
 	"github.com/spf13/cobra"
@@ -13,11 +16,41 @@ var (
 	downloadCmd = &cobra.Command{
 		Use:   "download <url> <destination file name>",
 		Short: "Download a third party rule file",
-		Long:  `Download a text file containing rules from a remote network for use in this local dns server.`,
-		RunE:  runDownloadSubCommand,
+		Long: `Download a text file containing rules from a remote network for use in this local dns server.
+The file is only put in place once it has been checked against --sha256 and --pubkey, if given, and loads cleanly.`,
+		RunE: runDownloadSubCommand,
 	}
+
+	downloadSHA256    string
+	downloadPublicKey string
+	downloadSignature string
 )
 
+func init() {
+	downloadCmd.Flags().StringVar(&downloadSHA256, "sha256", "", "hex SHA-256 sum the file must have")
+	downloadCmd.Flags().StringVar(&downloadPublicKey, "pubkey", "", "base64 ed25519 or minisign public key the file must be signed with")
+	downloadCmd.Flags().StringVar(&downloadSignature, "signature", "", "url or path of the signature (default <url>.minisig)")
+}
+
+// readSignature reads a signature from a url or a local file.
+func readSignature(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return ioutil.ReadFile(location)
+	}
+
+	resp, err := http.Get(location)
+	if err != nil {
+		return nil, fmt.Errorf("could not download signature from url: '%v'", location)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP request to '%v' gave a %v status code", location, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
 func runDownloadSubCommand(cmd *cobra.Command, args []string) error {
 	if len(args) != 2 {
 		return cmd.Help()
@@ -28,12 +61,30 @@ func runDownloadSubCommand(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	patterns, err := rules.DownloadRuleFile(u.String(), args[1])
+	verification := rules.Verification{SHA256: downloadSHA256, PublicKey: downloadPublicKey}
+
+	if verification.PublicKey != "" {
+		location := downloadSignature
+		if location == "" {
+			location = u.String() + ".minisig"
+		}
+
+		if verification.Signature, err = readSignature(location); err != nil {
+			return err
+		}
+	}
+
+	patterns, err := rules.DownloadRuleFile(u.String(), args[1], verification)
 
 	if err != nil {
 		return err
 	}
 
 	fmt.Printf("Downloaded '%v' to %v (%v patterns)\n", u.String(), path.Join("/etc/dnsfsd/rules", args[1]), patterns)
+
+	if !verification.Empty() {
+		println("The download was verified")
+	}
+
 	return nil
 }
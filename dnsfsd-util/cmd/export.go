@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/clr1107/dnsfsd/pkg/rules"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportCmd = &cobra.Command{
+		Use:   "export --to <format> [file]",
+		Short: "Export the rules to another blocker's format",
+		Long: `Export the loaded rules, and local records from hosts files, to another blocker's format (hosts, adblock, dnsmasq or unbound).
+The export is written to the given file, or stdout if none is given. Rules that cannot be written exactly in that format, such as most regular expressions, are listed on stderr.`,
+		RunE: runExportSubCommand,
+	}
+
+	exportTo string
+)
+
+func init() {
+	exportCmd.Flags().StringVar(&exportTo, "to", "", "format to export to: hosts, adblock, dnsmasq or unbound")
+	exportCmd.MarkFlagRequired("to")
+}
+
+func runExportSubCommand(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return cmd.Help()
+	}
+
+	to, err := rules.ParseExportFormat(exportTo)
+	if err != nil {
+		return err
+	}
+
+	files, err := loadRules()
+	if err != nil {
+		return err
+	}
+
+	ruleset := rules.CollectAllRules(files)
+	var out io.Writer = os.Stdout
+
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return fmt.Errorf("could not create file '%v'", args[0])
+		}
+		defer f.Close()
+
+		out = f
+	}
+
+	written, warnings, err := rules.Export(ruleset, out, to)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", v)
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %v of %v rules to %v with %v warnings\n", written, ruleset.Size(), to, len(warnings))
+	return nil
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/clr1107/dnsfsd/pkg/rules"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fixturesCmd = &cobra.Command{
+		Use:   "test <fixture file>...",
+		Short: "Test the rules against fixture files of expected outcomes",
+		Long: `Test the rules against fixture files of expected outcomes, one per line: 'domain -> sink' or 'domain -> forward'. Lines starting with # are comments.
+Each failed expectation is reported with the rule that caused it. Exits with 0 if every expectation holds, 1 if any fail and 2 if the fixtures or rules could not be loaded.`,
+		RunE: runFixturesSubCommand,
+	}
+
+	fixturesVerbose bool
+)
+
+func init() {
+	fixturesCmd.Flags().BoolVarP(&fixturesVerbose, "verbose", "v", false, "also print the expectations that hold")
+	patternsCmd.AddCommand(fixturesCmd)
+}
+
+func runFixturesSubCommand(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return cmd.Help()
+	}
+
+	fixtures := make([]rules.Fixture, 0)
+
+	for _, v := range args {
+		loaded, err := rules.LoadFixtures(v)
+		if err != nil {
+			return exitError{2, err}
+		}
+
+		fixtures = append(fixtures, loaded...)
+	}
+
+	files, err := loadRules()
+	if err != nil {
+		return exitError{2, err}
+	}
+
+	failed := 0
+
+	for _, v := range rules.CollectAllRules(files).TestFixtures(fixtures) {
+		if !v.Passed {
+			failed++
+		}
+
+		if !v.Passed || fixturesVerbose {
+			fmt.Println(v)
+		}
+	}
+
+	fmt.Printf("%v of %v expectations held\n", len(fixtures)-failed, len(fixtures))
+
+	if failed > 0 {
+		return exitError{1, fmt.Errorf("%v expectations failed", failed)}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/clr1107/dnsfsd/pkg/rules"
+	"github.com/spf13/cobra"
+)
+
+var (
+	lintCmd = &cobra.Command{
+		Use:   "lint",
+		Short: "Check the rules for mistakes",
+		Long: `Check the rules for mistakes that loading them does not catch: lines that cannot be parsed, duplicate rules, whitelist rules that no blacklist rule would ever hit, unanchored or slow regular expressions, very short contains rules, and whitespace or upper case letters that can never match.
+Exits with 0 if there are no errors, 1 if there are (or warnings, with --fail-on-warnings) and 2 if the rules could not be checked.`,
+		RunE: runLintSubCommand,
+	}
+
+	lintJSON           bool
+	lintFailOnWarnings bool
+)
+
+func init() {
+	lintCmd.Flags().BoolVar(&lintJSON, "json", false, "print the issues as JSON")
+	lintCmd.Flags().BoolVar(&lintFailOnWarnings, "fail-on-warnings", false, "exit with 1 if there are warnings")
+	patternsCmd.AddCommand(lintCmd)
+}
+
+func runLintSubCommand(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Help()
+	}
+
+	files, err := loadRulesMode(rules.LoadLenient)
+	if err != nil {
+		return exitError{2, err}
+	}
+
+	issues := rules.Lint(files)
+	counts := make(map[rules.LintSeverity]int)
+
+	for _, v := range issues {
+		counts[v.Severity]++
+	}
+
+	if lintJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(issues); err != nil {
+			return exitError{2, err}
+		}
+	} else {
+		for _, v := range issues {
+			fmt.Println(v)
+		}
+
+		fmt.Printf("%v errors, %v warnings, %v infos\n", counts[rules.LintError], counts[rules.LintWarning], counts[rules.LintInfo])
+	}
+
+	if counts[rules.LintError] > 0 || (lintFailOnWarnings && counts[rules.LintWarning] > 0) {
+		return exitError{1, fmt.Errorf("lint found %v errors and %v warnings", counts[rules.LintError], counts[rules.LintWarning])}
+	}
+
+	return nil
+}
@@ -25,6 +25,8 @@ func init() {
 	rootCmd.AddCommand(cleanCmd)
 	rootCmd.AddCommand(logCmd)
 	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(convertCmd)
+	rootCmd.AddCommand(exportCmd)
 }
 
 func timeIt(do func()) time.Duration {
@@ -33,6 +35,27 @@ func timeIt(do func()) time.Duration {
 	return time.Now().Sub(start)
 }
 
+// exitError is an error that should end the program with a particular exit
+// code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e exitError) Error() string {
+	return e.err.Error()
+}
+
+// ExitCode returns the code the program should exit with after err, which is
+// 1 unless a command chose otherwise.
+func ExitCode(err error) int {
+	if e, ok := err.(exitError); ok {
+		return e.code
+	}
+
+	return 1
+}
+
 func ExecuteRoot() error {
 	return rootCmd.Execute()
 }
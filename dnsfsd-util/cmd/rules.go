@@ -12,13 +12,24 @@ var (
 	patternsCmd = &cobra.Command{
 		Use:   "rules",
 		Short: "List rules. If there are a large amount of rules this could take a long time!",
-		Long:  `List all the rules currently being matched. If there are a large amount of rules this could take a long time!`,
-		RunE:  runPatternsSubCommand,
+		Long: `List all the rules currently being matched. If there are a large amount of rules this could take a long time!
+Lines that cannot be parsed are listed with the file, line and column of the problem. With --strict the first of them is an error instead, for use in CI.`,
+		RunE: runPatternsSubCommand,
 	}
+
+	patternsStrict bool
 )
 
+func init() {
+	patternsCmd.Flags().BoolVar(&patternsStrict, "strict", false, "fail on the first line that cannot be parsed")
+}
+
 func loadRules() (*[]rules.RuleFile, error) {
-	return rules.LoadAllRuleFiles("/etc/dnsfsd/rules")
+	return loadRulesMode(rules.LoadLenient)
+}
+
+func loadRulesMode(mode rules.LoadMode) (*[]rules.RuleFile, error) {
+	return rules.LoadAllRuleFiles("/etc/dnsfsd/rules", mode)
 }
 
 func runPatternsSubCommand(cmd *cobra.Command, args []string) error {
@@ -26,7 +37,12 @@ func runPatternsSubCommand(cmd *cobra.Command, args []string) error {
 		return cmd.Help()
 	}
 
-	files, err := loadRules()
+	mode := rules.LoadLenient
+	if patternsStrict {
+		mode = rules.LoadStrict
+	}
+
+	files, err := loadRulesMode(mode)
 
 	if err != nil {
 		return err
@@ -45,13 +61,23 @@ func runPatternsSubCommand(cmd *cobra.Command, args []string) error {
 	for _, i := range *files {
 		println()
 
-		header := fmt.Sprintf("File '%v' (%v)", i.Path, len(*i.Rules))
+		header := fmt.Sprintf("File '%v' (%v, %v)", i.Path, i.Format, len(*i.Rules))
 		println(header)
 		println(strings.Repeat("-", len(header)))
 
 		for k, j := range *i.Rules {
 			fmt.Printf("%v)    %v\n", k+1, j)
 		}
+
+		if i.Records != nil {
+			for _, j := range *i.Records {
+				fmt.Printf("local: %v\n", j)
+			}
+		}
+
+		for _, j := range *i.Diagnostics {
+			fmt.Printf("skipped %v\n", j)
+		}
 	}
 
 	return nil
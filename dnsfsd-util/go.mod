@@ -9,6 +9,7 @@ replace github.com/clr1107/dnsfsd/pkg => ../pkg
 
 require (
 	github.com/clr1107/dnsfsd/pkg v0.0.0-00010101000000-000000000000
+	github.com/miekg/dns v1.1.39
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/viper v1.7.1
 )
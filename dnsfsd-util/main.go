@@ -1,9 +1,13 @@
 package main
 
 import (
+	"os"
+
 	"github.com/clr1107/dnsfsd/dnsfsd-util/cmd"
 )
 
 func main() {
-	cmd.ExecuteRoot()
+	if err := cmd.ExecuteRoot(); err != nil {
+		os.Exit(cmd.ExitCode(err))
+	}
 }
@@ -1,10 +1,7 @@
 package cache
 
 import (
-	"encoding/gob"
-	"github.com/miekg/dns"
 	"github.com/patrickmn/go-cache"
-	"os"
 	"sync"
 	"time"
 )
@@ -124,47 +121,3 @@ func (s *SimpleCache) Clean() {
 func (s *SimpleCache) Size() int {
 	return len(s.Impl.Items())
 }
-
-type DNSCache struct {
-	*SimpleCache
-}
-
-func NewDNSCache(defaultTTL time.Duration) *DNSCache {
-	return &DNSCache{NewSimpleCache(defaultTTL)}
-}
-
-func registerGobTypes() {
-	gob.Register(dns.Question{})
-	gob.Register(make([]dns.RR, 0))
-	gob.Register(new(dns.A))
-	gob.Register(dns.CNAME{})
-	gob.Register(new(dns.AAAA))
-}
-
-func DNSCacheFromFile(defaultTTL time.Duration, path string) (*DNSCache, error) {
-	c := cache.New(defaultTTL, 5*time.Minute)
-	fp, err := os.Open(path)
-
-	if err != nil {
-		return nil, err
-	}
-
-	registerGobTypes()
-	if err := c.Load(fp); err != nil {
-		return nil, err
-	}
-
-	dc := NewDNSCache(defaultTTL)
-	dc.Impl = c
-
-	if err := fp.Close(); err != nil {
-		return nil, err
-	}
-
-	return dc, nil
-}
-
-func (d *DNSCache) SerialiseToFile(path string) error {
-	registerGobTypes()
-	return d.Impl.SaveFile(path)
-}
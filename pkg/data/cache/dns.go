@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSKey identifies a cached response: the name, type and class of the query,
+// and whether it asked for DNSSEC records (the DO bit), as the response differs
+// if it did.
+type DNSKey struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool
+}
+
+// NewDNSKey creates the DNSKey of a query. Names are not case sensitive.
+func NewDNSKey(r *dns.Msg) DNSKey {
+	question := r.Question[0]
+	key := DNSKey{Name: strings.ToLower(dns.Fqdn(question.Name)), Qtype: question.Qtype, Qclass: question.Qclass}
+
+	if opt := r.IsEdns0(); opt != nil {
+		key.DO = opt.Do()
+	}
+
+	return key
+}
+
+func (k DNSKey) String() string {
+	s := k.Name + " " + strconv.Itoa(int(k.Qclass)) + " " + strconv.Itoa(int(k.Qtype))
+
+	if k.DO {
+		s += " do"
+	}
+
+	return s
+}
+
+// negative returns true for an NXDOMAIN reply, or a NOERROR reply with no
+// answer (NODATA).
+func negative(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0)
+}
+
+// DNSCache is an LRUCache of complete DNS responses, packed as they were
+// received. A positive response is kept for the lowest TTL of its answer,
+// clamped between MinTTL and MaxTTL, and a negative one for the TTL given by
+// its SOA record (RFC 2308), capped at NegativeTTL. Expired responses are kept
+// for the Stale window of the LRUCache, to be served if upstreams fail.
+type DNSCache struct {
+	*LRUCache
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration
+}
+
+// NewDNSCache creates a new DNSCache with the given TTL clamps, holding at most
+// maxEntries responses and roughly maxBytes bytes. A MaxTTL of 0 caches
+// nothing, and a NegativeTTL of 0 no negative responses.
+func NewDNSCache(minTTL time.Duration, maxTTL time.Duration, negativeTTL time.Duration, maxEntries int, maxBytes int64) *DNSCache {
+	return &DNSCache{NewLRUCache(maxTTL, maxEntries, maxBytes), minTTL, maxTTL, negativeTTL}
+}
+
+// TTL returns how long a response is cached for, or 0 if it is not cached.
+// Only successful and negative responses are cached. The TTL of a negative
+// response is the lower of its SOA record's TTL and minimum field; without one
+// it is not cached.
+func (d *DNSCache) TTL(msg *dns.Msg) time.Duration {
+	if negative(msg) {
+		for _, v := range msg.Ns {
+			if soa, ok := v.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+
+				return clampTTL(time.Duration(ttl)*time.Second, 0, minDuration(d.NegativeTTL, d.MaxTTL))
+			}
+		}
+
+		return 0
+	}
+
+	if msg.Rcode != dns.RcodeSuccess {
+		return 0
+	}
+
+	lowest := msg.Answer[0].Header().Ttl
+
+	for _, v := range msg.Answer[1:] {
+		if v.Header().Ttl < lowest {
+			lowest = v.Header().Ttl
+		}
+	}
+
+	return clampTTL(time.Duration(lowest)*time.Second, d.MinTTL, d.MaxTTL)
+}
+
+func clampTTL(ttl time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if ttl < min {
+		ttl = min
+	}
+
+	if ttl > max {
+		ttl = max
+	}
+
+	return ttl
+}
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// PutResponse caches a response for its TTL. Returns false if it is not
+// cached, as its TTL is 0 or it could not be packed.
+func (d *DNSCache) PutResponse(key DNSKey, msg *dns.Msg) bool {
+	ttl := d.TTL(msg)
+
+	if ttl <= 0 {
+		return false
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return false
+	}
+
+	return d.Put(key.String(), packed, ttl)
+}
+
+// GetResponse returns the response cached for a key, as it was received, or
+// nil if there is none. The TTL of each record is counted down to the time the
+// response has left in the cache, if that is less. The message ID is the one
+// the response was received with.
+func (d *DNSCache) GetResponse(key DNSKey) *dns.Msg {
+	val, expires, ok := d.GetWithExpiration(key.String())
+	if !ok {
+		return nil
+	}
+
+	msg := d.unpack(key, val)
+
+	if msg != nil && !expires.IsZero() {
+		// rounded up, so a response just cached keeps its TTLs
+		countDown(msg, uint32((time.Until(expires)+time.Second-1)/time.Second))
+	}
+
+	return msg
+}
+
+// GetStaleResponse returns the response cached for a key even if it has
+// expired, as long as it is within the stale window (RFC 8767), or nil if there
+// is none. The TTL of each record of an expired response is lowered to at most
+// staleTTL; a response that has not expired is counted down as by GetResponse.
+func (d *DNSCache) GetStaleResponse(key DNSKey, staleTTL uint32) *dns.Msg {
+	val, expires, ok := d.GetStale(key.String())
+	if !ok {
+		return nil
+	}
+
+	msg := d.unpack(key, val)
+
+	if msg != nil && !expires.IsZero() {
+		remaining := staleTTL
+
+		if left := time.Until(expires); left > 0 {
+			remaining = uint32((left + time.Second - 1) / time.Second)
+		}
+
+		countDown(msg, remaining)
+	}
+
+	return msg
+}
+
+// unpack unpacks a cached response, removing it from the cache if it is not
+// one.
+func (d *DNSCache) unpack(key DNSKey, val interface{}) *dns.Msg {
+	msg := new(dns.Msg)
+	packed, ok := val.([]byte)
+
+	if !ok || msg.Unpack(packed) != nil {
+		d.Remove(key.String()) // for some reason not a response?
+		return nil
+	}
+
+	return msg
+}
+
+// countDown lowers the TTLs of the records of a response to at most remaining.
+// The OPT record has no TTL; its TTL field holds EDNS flags.
+func countDown(msg *dns.Msg, remaining uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, v := range section {
+			if _, ok := v.(*dns.OPT); !ok && v.Header().Ttl > remaining {
+				v.Header().Ttl = remaining
+			}
+		}
+	}
+}
+
+// LoadFromFile adds the responses saved by SerialiseToFile that are not past
+// the stale window since.
+func (d *DNSCache) LoadFromFile(path string) error {
+	fp, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return d.Load(fp)
+}
+
+func (d *DNSCache) SerialiseToFile(path string) error {
+	fp, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.Save(fp); err != nil {
+		fp.Close()
+		return err
+	}
+
+	return fp.Close()
+}
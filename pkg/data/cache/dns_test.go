@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testAnswer(ttls ...uint32) []dns.RR {
+	answer := make([]dns.RR, 0, len(ttls))
+
+	for _, v := range ttls {
+		hdr := dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: v}
+		answer = append(answer, &dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")})
+	}
+
+	return answer
+}
+
+func testSOA(ttl uint32, minttl uint32) []dns.RR {
+	hdr := dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl}
+	return []dns.RR{&dns.SOA{Hdr: hdr, Ns: "a.gtld-servers.net.", Mbox: "nstld.verisign-grs.com.", Minttl: minttl}}
+}
+
+// testResponse creates a response to an A query for name.
+func testResponse(name string, rcode int, answer []dns.RR, ns []dns.RR) *dns.Msg {
+	m := new(dns.Msg).SetRcode(new(dns.Msg).SetQuestion(name, dns.TypeA), rcode)
+	m.Answer, m.Ns = answer, ns
+
+	return m
+}
+
+func TestDNSKey(t *testing.T) {
+	query := new(dns.Msg).SetQuestion("Example.COM.", dns.TypeAAAA)
+	key := NewDNSKey(query)
+
+	if key != (DNSKey{"example.com.", dns.TypeAAAA, dns.ClassINET, false}) {
+		t.Fatalf("unexpected key %v", key)
+	}
+
+	query.SetEdns0(1232, true)
+
+	if signed := NewDNSKey(query); signed.DO != true || signed == key || signed.String() == key.String() {
+		t.Fatalf("DO bit did not change the key: %v", signed)
+	}
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	cache := NewDNSCache(30*time.Second, time.Hour, 10*time.Minute, 0, 0)
+
+	cases := []struct {
+		response *dns.Msg
+		expected time.Duration
+	}{
+		{testResponse("a.", dns.RcodeSuccess, testAnswer(300, 60, 3600), nil), 60 * time.Second},
+		{testResponse("a.", dns.RcodeSuccess, testAnswer(5), nil), 30 * time.Second},
+		{testResponse("a.", dns.RcodeSuccess, testAnswer(86400), nil), time.Hour},
+		{testResponse("a.", dns.RcodeNameError, nil, testSOA(900, 300)), 5 * time.Minute},
+		{testResponse("a.", dns.RcodeNameError, nil, testSOA(120, 86400)), 2 * time.Minute},
+		{testResponse("a.", dns.RcodeSuccess, nil, testSOA(86400, 86400)), 10 * time.Minute},
+		{testResponse("a.", dns.RcodeSuccess, nil, nil), 0},
+		{testResponse("a.", dns.RcodeNameError, nil, nil), 0},
+		{testResponse("a.", dns.RcodeServerFailure, nil, testSOA(900, 300)), 0},
+	}
+
+	for _, v := range cases {
+		if ttl := cache.TTL(v.response); ttl != v.expected {
+			t.Fatalf("response %v cached for %v, expected %v", v.response, ttl, v.expected)
+		}
+	}
+
+	failed := testResponse("failed.", dns.RcodeServerFailure, nil, nil)
+	if cache.PutResponse(NewDNSKey(failed), failed) || cache.Size() != 0 {
+		t.Fatalf("failed response was cached")
+	}
+
+	positive := testResponse("disabled.", dns.RcodeSuccess, testAnswer(60), nil)
+	if NewDNSCache(0, 0, time.Hour, 0, 0).PutResponse(NewDNSKey(positive), positive) {
+		t.Fatalf("response was cached with a MaxTTL of 0")
+	}
+
+	negative := testResponse("disabled.", dns.RcodeNameError, nil, testSOA(60, 60))
+	if NewDNSCache(0, time.Hour, 0, 0, 0).PutResponse(NewDNSKey(negative), negative) {
+		t.Fatalf("negative response was cached with a NegativeTTL of 0")
+	}
+}
+
+func TestDNSCacheFidelity(t *testing.T) {
+	cache := NewDNSCache(0, time.Hour, time.Hour, 0, 0)
+
+	response := testResponse("example.com.", dns.RcodeSuccess, testAnswer(300), testSOA(300, 300))
+	response.Authoritative, response.AuthenticatedData = true, true
+	response.Extra = testAnswer(300)
+	response.SetEdns0(1232, true)
+
+	key := NewDNSKey(response)
+	cache.PutResponse(key, response)
+
+	cached := cache.GetResponse(key)
+	if cached == nil {
+		t.Fatalf("response was not cached")
+	}
+
+	if cached.String() != response.String() {
+		t.Fatalf("response was returned as\n%v\nexpected\n%v", cached, response)
+	}
+
+	if cache.GetResponse(DNSKey{"example.com.", dns.TypeA, dns.ClassINET, false}) != nil {
+		t.Fatalf("response to a query with the DO bit was returned for one without")
+	}
+}
+
+func TestDNSCacheCountdown(t *testing.T) {
+	cache := NewDNSCache(0, time.Hour, time.Hour, 0, 0)
+
+	positive := testResponse("example.com.", dns.RcodeSuccess, testAnswer(2, 300), nil)
+	positive.SetEdns0(1232, true)
+	negative := testResponse("nx.example.com.", dns.RcodeNameError, nil, testSOA(900, 2))
+
+	cache.PutResponse(NewDNSKey(positive), positive)
+	cache.PutResponse(NewDNSKey(negative), negative)
+
+	r := cache.GetResponse(NewDNSKey(positive))
+	if r == nil || len(r.Answer) != 2 || r.Answer[0].Header().Ttl != 2 || r.Answer[1].Header().Ttl != 2 {
+		t.Fatalf("response just cached was returned as %v, expected TTLs of 2", r)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	r = cache.GetResponse(NewDNSKey(positive))
+	if r == nil || len(r.Answer) != 2 || r.Answer[0].Header().Ttl != 1 || r.Answer[1].Header().Ttl != 1 {
+		t.Fatalf("response was returned as %v, expected TTLs counted down to 1", r)
+	}
+
+	if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+		t.Fatalf("EDNS flags were counted down as a TTL: %v", r)
+	}
+
+	r = cache.GetResponse(NewDNSKey(negative))
+	if r == nil || r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Ttl != 1 {
+		t.Fatalf("negative response was returned as %v, expected NXDOMAIN with a SOA TTL of 1", r)
+	}
+
+	time.Sleep(time.Second)
+
+	if cache.GetResponse(NewDNSKey(positive)) != nil || cache.GetResponse(NewDNSKey(negative)) != nil {
+		t.Fatalf("response was returned after its TTL")
+	}
+}
+
+func TestDNSCacheStale(t *testing.T) {
+	cache := NewDNSCache(0, 100*time.Millisecond, time.Hour, 0, 0)
+	cache.Stale = time.Hour
+
+	positive := testResponse("example.com.", dns.RcodeSuccess, testAnswer(300, 10), nil)
+	cache.PutResponse(NewDNSKey(positive), positive)
+
+	r := cache.GetStaleResponse(NewDNSKey(positive), 30)
+	if r == nil || r.Answer[0].Header().Ttl != 1 || r.Answer[1].Header().Ttl != 1 {
+		t.Fatalf("response that has not expired was returned as %v, expected TTLs counted down to 1", r)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if cache.GetResponse(NewDNSKey(positive)) != nil {
+		t.Fatalf("response was returned after its TTL")
+	}
+
+	r = cache.GetStaleResponse(NewDNSKey(positive), 30)
+	if r == nil || r.Answer[0].Header().Ttl != 30 || r.Answer[1].Header().Ttl != 10 {
+		t.Fatalf("stale response was returned as %v, expected TTLs of 30 and 10", r)
+	}
+
+	if stats := cache.Stats(); stats.StaleHits != 1 || stats.Expirations != 0 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	cache.Stale = 0
+
+	if cache.GetStaleResponse(NewDNSKey(positive), 30) != nil || cache.Size() != 0 {
+		t.Fatalf("response past the stale window was returned")
+	}
+}
+
+func TestDNSCacheFile(t *testing.T) {
+	filepath := path.Join(t.TempDir(), "dns.cache")
+	cache := NewDNSCache(0, time.Hour, time.Hour, 0, 0)
+
+	positive := testResponse("example.com.", dns.RcodeSuccess, testAnswer(300), nil)
+	negative := testResponse("nx.example.com.", dns.RcodeNameError, nil, testSOA(900, 300))
+
+	cache.PutResponse(NewDNSKey(positive), positive)
+	cache.PutResponse(NewDNSKey(negative), negative)
+
+	if err := cache.SerialiseToFile(filepath); err != nil {
+		t.Fatalf("could not save the cache: %v", err)
+	}
+
+	loaded := NewDNSCache(0, time.Hour, time.Hour, 0, 0)
+	if err := loaded.LoadFromFile(filepath); err != nil {
+		t.Fatalf("could not load the cache: %v", err)
+	}
+
+	if r := loaded.GetResponse(NewDNSKey(positive)); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("positive response was loaded as %v", r)
+	}
+
+	if r := loaded.GetResponse(NewDNSKey(negative)); r == nil || r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+		t.Fatalf("negative response was loaded as %v", r)
+	}
+}
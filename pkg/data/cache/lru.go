@@ -0,0 +1,350 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// entryOverhead is roughly how many bytes the bookkeeping of an LRUCache entry
+// takes, on top of its key and value.
+const entryOverhead int64 = 128
+
+// Stats counts what a cache holds, and what it has done since it was created.
+type Stats struct {
+	Entries     int
+	Bytes       int64 // approximate
+	Hits        uint64
+	Misses      uint64
+	StaleHits   uint64 // expired entries returned by GetStale
+	Evictions   uint64 // entries removed to make room for others
+	Expirations uint64 // entries removed as they had expired
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%v entries (%v bytes), %v hits, %v misses, %v stale hits, %v evictions, %v expirations",
+		s.Entries, s.Bytes, s.Hits, s.Misses, s.StaleHits, s.Evictions, s.Expirations)
+}
+
+// lruEntry is an entry of an LRUCache. expires is in Unix nanoseconds, or 0 if
+// the entry never expires.
+type lruEntry struct {
+	key     string
+	val     interface{}
+	size    int64
+	expires int64
+}
+
+func (e *lruEntry) expired(now int64) bool {
+	return e.expires > 0 && now > e.expires
+}
+
+// expiration returns when the entry expires, or a zero time.Time if it never
+// does.
+func (e *lruEntry) expiration() time.Time {
+	if e.expires == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, e.expires)
+}
+
+// gone returns true if the entry has expired, and has been stale for longer
+// than the stale window.
+func (e *lruEntry) gone(now int64, stale time.Duration) bool {
+	return e.expires > 0 && now > e.expires+int64(stale)
+}
+
+// LRUCache is a thread-safe implementation of ICache that holds at most
+// MaxEntries entries and roughly MaxBytes bytes; a limit of 0 is no limit. When
+// a limit is reached the least recently used entries are evicted. The size of
+// an entry is its key, its value if that is a []byte or a string, and a fixed
+// overhead.
+//
+// Expired entries are kept for Stale longer, during which only GetStale
+// returns them.
+type LRUCache struct {
+	MaxEntries int
+	MaxBytes   int64
+	DefaultTTL time.Duration
+	Stale      time.Duration
+
+	lock        sync.Mutex
+	items       map[string]*list.Element
+	order       *list.List // most recently used first
+	bytes       int64
+	defaultTTLs map[string]time.Duration
+	stats       Stats
+}
+
+// NewLRUCache creates a new LRUCache with the given default ttl and limits. A
+// ttl of 0 or less never expires.
+func NewLRUCache(defaultTTL time.Duration, maxEntries int, maxBytes int64) *LRUCache {
+	return &LRUCache{
+		MaxEntries:  maxEntries,
+		MaxBytes:    maxBytes,
+		DefaultTTL:  defaultTTL,
+		items:       make(map[string]*list.Element),
+		order:       list.New(),
+		defaultTTLs: make(map[string]time.Duration),
+	}
+}
+
+func sizeOf(key string, val interface{}) int64 {
+	size := entryOverhead + int64(len(key))
+
+	switch v := val.(type) {
+	case []byte:
+		size += int64(len(v))
+	case string:
+		size += int64(len(v))
+	}
+
+	return size
+}
+
+// Put inserts a value, evicting the least recently used entries if a limit is
+// reached. Returns false if the value alone is larger than MaxBytes.
+func (l *LRUCache) Put(key string, val interface{}, ttl time.Duration) bool {
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+
+	return l.put(key, val, expires)
+}
+
+func (l *LRUCache) put(key string, val interface{}, expires int64) bool {
+	size := sizeOf(key, val)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if e, ok := l.items[key]; ok {
+		l.remove(e)
+	}
+
+	if l.MaxBytes > 0 && size > l.MaxBytes {
+		return false
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry{key, val, size, expires})
+	l.bytes += size
+
+	for (l.MaxEntries > 0 && l.order.Len() > l.MaxEntries) || (l.MaxBytes > 0 && l.bytes > l.MaxBytes) {
+		l.remove(l.order.Back())
+		l.stats.Evictions++
+	}
+
+	return true
+}
+
+func (l *LRUCache) PutDefault(key string, val interface{}) bool {
+	l.lock.Lock()
+	ttl, ok := l.defaultTTLs[key]
+	l.lock.Unlock()
+
+	if !ok {
+		ttl = l.DefaultTTL
+	}
+
+	return l.Put(key, val, ttl)
+}
+
+// remove removes an entry. The lock must be held.
+func (l *LRUCache) remove(e *list.Element) {
+	entry := l.order.Remove(e).(*lruEntry)
+	delete(l.items, entry.key)
+	l.bytes -= entry.size
+}
+
+func (l *LRUCache) Get(key string) interface{} {
+	val, _, _ := l.GetWithExpiration(key)
+	return val
+}
+
+// GetWithExpiration returns the value associated with a key and when it
+// expires, a zero time.Time if it never does, marking it as the most recently
+// used. The bool is false if there is no such value, or it has expired.
+func (l *LRUCache) GetWithExpiration(key string) (interface{}, time.Time, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e, ok := l.items[key]
+	if !ok {
+		l.stats.Misses++
+		return nil, time.Time{}, false
+	}
+
+	entry := e.Value.(*lruEntry)
+	now := time.Now().UnixNano()
+
+	if entry.expired(now) {
+		if entry.gone(now, l.Stale) {
+			l.remove(e)
+			l.stats.Expirations++
+		}
+
+		l.stats.Misses++
+		return nil, time.Time{}, false
+	}
+
+	l.order.MoveToFront(e)
+	l.stats.Hits++
+
+	return entry.val, entry.expiration(), true
+}
+
+// GetStale is GetWithExpiration, but also returns entries that have expired
+// within the stale window. It is meant to be called after a miss, so only
+// stale entries returned are counted.
+func (l *LRUCache) GetStale(key string) (interface{}, time.Time, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e, ok := l.items[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	entry := e.Value.(*lruEntry)
+	now := time.Now().UnixNano()
+
+	if entry.gone(now, l.Stale) {
+		l.remove(e)
+		l.stats.Expirations++
+
+		return nil, time.Time{}, false
+	}
+
+	l.order.MoveToFront(e)
+
+	if entry.expired(now) {
+		l.stats.StaleHits++
+	}
+
+	return entry.val, entry.expiration(), true
+}
+
+func (l *LRUCache) Remove(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e, ok := l.items[key]
+	if ok {
+		l.remove(e)
+	}
+
+	return ok
+}
+
+// Contains returns if the key is in the cache and has not expired. It does not
+// count as a use of the entry.
+func (l *LRUCache) Contains(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e, ok := l.items[key]
+	return ok && !e.Value.(*lruEntry).expired(time.Now().UnixNano())
+}
+
+func (l *LRUCache) SetDefaultTTL(key string, ttl time.Duration) {
+	l.lock.Lock()
+	l.defaultTTLs[key] = ttl
+	l.lock.Unlock()
+}
+
+func (l *LRUCache) Clear() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.items = make(map[string]*list.Element)
+	l.order.Init()
+	l.bytes = 0
+}
+
+// Clean removes every entry that has expired, and is past the stale window.
+func (l *LRUCache) Clean() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now().UnixNano()
+
+	for e := l.order.Front(); e != nil; {
+		next := e.Next()
+
+		if e.Value.(*lruEntry).gone(now, l.Stale) {
+			l.remove(e)
+			l.stats.Expirations++
+		}
+
+		e = next
+	}
+}
+
+func (l *LRUCache) Size() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.order.Len()
+}
+
+// Stats returns what the cache holds and has done.
+func (l *LRUCache) Stats() Stats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	stats := l.stats
+	stats.Entries, stats.Bytes = l.order.Len(), l.bytes
+
+	return stats
+}
+
+// lruItem is an entry of an LRUCache as it is saved.
+type lruItem struct {
+	Key     string
+	Object  interface{}
+	Expires int64
+}
+
+// Save writes every entry that is not past the stale window to w with gob,
+// least recently used first. Values of types other than gob's basic types must
+// be registered with gob.Register.
+func (l *LRUCache) Save(w io.Writer) error {
+	l.lock.Lock()
+	now := time.Now().UnixNano()
+	items := make([]lruItem, 0, l.order.Len())
+
+	for e := l.order.Back(); e != nil; e = e.Prev() {
+		if entry := e.Value.(*lruEntry); !entry.gone(now, l.Stale) {
+			items = append(items, lruItem{entry.key, entry.val, entry.expires})
+		}
+	}
+
+	l.lock.Unlock()
+
+	return gob.NewEncoder(w).Encode(items)
+}
+
+// Load adds the entries written by Save that are not past the stale window
+// since, keeping the order in which they were used.
+func (l *LRUCache) Load(r io.Reader) error {
+	items := make([]lruItem, 0)
+
+	if err := gob.NewDecoder(r).Decode(&items); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+
+	for _, v := range items {
+		if entry := (lruEntry{expires: v.Expires}); !entry.gone(now, l.Stale) {
+			l.put(v.Key, v.Object, v.Expires)
+		}
+	}
+
+	return nil
+}
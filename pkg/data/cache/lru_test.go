@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLRUEntryLimit(t *testing.T) {
+	cache := NewLRUCache(-1, 3, 0)
+
+	for i := 0; i < 3; i++ {
+		cache.PutDefault(strconv.Itoa(i), i)
+	}
+
+	// 0 is now the most recently used, so 1 is evicted first
+	if cache.Get("0") != 0 {
+		t.Fatalf("value was not cached")
+	}
+
+	cache.PutDefault("3", 3)
+	cache.PutDefault("4", 4)
+
+	for key, cached := range map[string]bool{"0": true, "1": false, "2": false, "3": true, "4": true} {
+		if cache.Contains(key) != cached {
+			t.Fatalf("key %v cached: %v, expected %v", key, !cached, cached)
+		}
+	}
+
+	if stats := cache.Stats(); stats.Entries != 3 || stats.Evictions != 2 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
+
+func TestLRUByteLimit(t *testing.T) {
+	value := make([]byte, 1000)
+	cache := NewLRUCache(-1, 0, 3*(sizeOf("0", value)))
+
+	for i := 0; i < 5; i++ {
+		if !cache.PutDefault(strconv.Itoa(i), value) {
+			t.Fatalf("value within the byte limit was not cached")
+		}
+	}
+
+	if stats := cache.Stats(); stats.Entries != 3 || stats.Bytes > cache.MaxBytes || stats.Evictions != 2 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	if cache.PutDefault("large", make([]byte, 4000)) || cache.Contains("large") || cache.Size() != 3 {
+		t.Fatalf("value larger than the byte limit was cached")
+	}
+
+	// replacing a value does not count its old size
+	cache.PutDefault("4", value)
+
+	if stats := cache.Stats(); stats.Entries != 3 || stats.Evictions != 2 {
+		t.Fatalf("replacing a value evicted another: %v", stats)
+	}
+}
+
+func TestLRUStats(t *testing.T) {
+	cache := NewLRUCache(-1, 0, 0)
+
+	cache.Put("short", 1, 50*time.Millisecond)
+	cache.PutDefault("long", 2)
+
+	cache.Get("long")
+	cache.Get("missing")
+	time.Sleep(100 * time.Millisecond)
+	cache.Get("short")
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Expirations != 1 || stats.Entries != 1 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	cache.Put("short", 1, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	cache.Clean()
+
+	if stats := cache.Stats(); stats.Expirations != 2 || stats.Entries != 1 {
+		t.Fatalf("expired entry was not cleaned: %v", stats)
+	}
+}
+
+func TestLRUStale(t *testing.T) {
+	cache := NewLRUCache(-1, 0, 0)
+	cache.Stale = time.Hour
+
+	cache.Put("stale", 1, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	cache.Clean()
+
+	if cache.Get("stale") != nil || cache.Contains("stale") {
+		t.Fatalf("expired entry was returned")
+	}
+
+	if val, _, ok := cache.GetStale("stale"); !ok || val != 1 {
+		t.Fatalf("stale entry was not kept")
+	}
+
+	if _, _, ok := cache.GetStale("missing"); ok {
+		t.Fatalf("missing entry was returned")
+	}
+
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Misses != 1 || stats.StaleHits != 1 || stats.Expirations != 0 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
+
+func TestLRUSaveLoad(t *testing.T) {
+	cache := NewLRUCache(-1, 0, 0)
+
+	for i := 0; i < 3; i++ {
+		cache.PutDefault(strconv.Itoa(i), []byte{byte(i)})
+	}
+
+	cache.Get("0")
+	cache.Put("expiring", []byte{}, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	var buf bytes.Buffer
+
+	if err := cache.Save(&buf); err != nil {
+		t.Fatalf("could not save the cache: %v", err)
+	}
+
+	loaded := NewLRUCache(-1, 2, 0)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("could not load the cache: %v", err)
+	}
+
+	// 1 was the least recently used, so it does not fit
+	for key, cached := range map[string]bool{"0": true, "1": false, "2": true, "expiring": false} {
+		if loaded.Contains(key) != cached {
+			t.Fatalf("key %v loaded: %v, expected %v", key, !cached, cached)
+		}
+	}
+}
@@ -25,10 +25,36 @@ func InitConfig() error {
 	viper.SetConfigType("yaml")
 
 	setNestedDefault("server.port", 53)
+	setNestedDefault("server.parallel_match", false)
+	setNestedDefault("server.tls.enabled", false)
+	setNestedDefault("server.tls.port", 853)
+	setNestedDefault("server.tls.cert", "/etc/dnsfsd/tls/cert.pem")
+	setNestedDefault("server.tls.key", "/etc/dnsfsd/tls/key.pem")
+	setNestedDefault("server.https.enabled", false)
+	setNestedDefault("server.https.address", ":443")
+	setNestedDefault("server.https.path", "/dns-query")
+	setNestedDefault("server.https.plain", false)
+	setNestedDefault("server.https.cert", "/etc/dnsfsd/tls/cert.pem")
+	setNestedDefault("server.https.key", "/etc/dnsfsd/tls/key.pem")
 	setNestedDefault("dns.forwards", []string{"1.0.0.1:53", "1.1.1.1:53"})
 	setNestedDefault("log.path", "/var/log/dnsfsd/log.txt")
 	setNestedDefault("log.verbose", false)
+	setNestedDefault("log.stats_interval", "1h")
 	setNestedDefault("dns.cache", 86400)
+	setNestedDefault("dns.cache_min", 0)
+	setNestedDefault("dns.cache_negative", 3600)
+	setNestedDefault("dns.cache_stale", 86400)
+	setNestedDefault("dns.cache_entries", 100000)
+	setNestedDefault("dns.cache_bytes", 64<<20)
+	setNestedDefault("rules.watch", false)
+	setNestedDefault("rules.strict", false)
+	setNestedDefault("sink.mode", "nodata")
+	setNestedDefault("sink.ttl", 60)
+	setNestedDefault("sink.ipv4", []string{})
+	setNestedDefault("sink.ipv6", []string{})
+	setNestedDefault("sink.cache_entries", 100000)
+	setNestedDefault("sink.cache_bytes", 16<<20)
+	setNestedDefault("subscriptions", []interface{}{})
 
 	if err := viper.ReadInConfig(); err == nil {
 		ConfigLoaded = true
@@ -39,7 +65,50 @@ func InitConfig() error {
 	return nil
 }
 
+// GetCacheTime returns the longest a DNS answer is cached for, `dns.cache`.
 func GetCacheTime() time.Duration {
-	x := viper.GetInt("cache")
+	x := viper.GetInt("dns.cache")
 	return time.Duration(x) * time.Second
 }
+
+// GetCacheMinTime returns the shortest a DNS answer is cached for,
+// `dns.cache_min`, even if its TTL is lower.
+func GetCacheMinTime() time.Duration {
+	x := viper.GetInt("dns.cache_min")
+	return time.Duration(x) * time.Second
+}
+
+// GetCacheNegativeTime returns the longest an NXDOMAIN or NODATA response is
+// cached for, `dns.cache_negative`.
+func GetCacheNegativeTime() time.Duration {
+	x := viper.GetInt("dns.cache_negative")
+	return time.Duration(x) * time.Second
+}
+
+// GetCacheStaleTime returns how long an expired DNS answer is kept for,
+// `dns.cache_stale`, to be served if no upstream can be reached.
+func GetCacheStaleTime() time.Duration {
+	x := viper.GetInt("dns.cache_stale")
+	return time.Duration(x) * time.Second
+}
+
+// SubscriptionConfig is an entry of the `subscriptions` list: a rule list to
+// download and keep up to date.
+type SubscriptionConfig struct {
+	Name     string
+	URL      string
+	Format   string
+	Interval time.Duration
+}
+
+// GetSubscriptions returns the `subscriptions` list. Intervals are durations
+// such as `12h`.
+func GetSubscriptions() ([]SubscriptionConfig, error) {
+	subscriptions := make([]SubscriptionConfig, 0)
+
+	if err := viper.UnmarshalKey("subscriptions", &subscriptions); err != nil {
+		return nil, fmt.Errorf("could not read subscriptions: %v", err)
+	}
+
+	return subscriptions, nil
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"github.com/spf13/viper"
 	"testing"
+	"time"
 )
 
 func TestInit(t *testing.T) {
@@ -33,3 +34,31 @@ func TestDefaultNested(t *testing.T) {
 	}
 }
 
+func TestGetSubscriptions(t *testing.T) {
+	viper.Set("subscriptions", []interface{}{
+		map[interface{}]interface{}{"name": "ads", "url": "https://example.com/ads.txt", "format": "adblock", "interval": "12h"},
+	})
+	defer viper.Set("subscriptions", []interface{}{})
+
+	subscriptions, err := GetSubscriptions()
+	if err != nil {
+		t.Fatalf("error on #GetSubscriptions: %v", err)
+	}
+
+	if len(subscriptions) != 1 || subscriptions[0].Name != "ads" || subscriptions[0].Interval != 12*time.Hour {
+		t.Fatalf("unexpected subscriptions %v", subscriptions)
+	}
+}
+
+func TestGetCacheTime(t *testing.T) {
+	viper.Set("dns.cache", 3600)
+	viper.Set("dns.cache_min", 30)
+	viper.Set("dns.cache_negative", 300)
+	defer viper.Set("dns.cache", nil)
+	defer viper.Set("dns.cache_min", nil)
+	defer viper.Set("dns.cache_negative", nil)
+
+	if GetCacheTime() != time.Hour || GetCacheMinTime() != 30*time.Second || GetCacheNegativeTime() != 5*time.Minute {
+		t.Fatalf("cache times were read as %v, %v and %v", GetCacheTime(), GetCacheMinTime(), GetCacheNegativeTime())
+	}
+}
@@ -0,0 +1,176 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	adblockWhitelistPrefix string = "@@"
+	adblockDomainAnchor    string = "||"
+	adblockAnchor          string = "|"
+	adblockSeparator       string = "^"
+	adblockDNSType         string = "dnstype="
+)
+
+var (
+	// the characters a pattern may hold and still be matched against a domain
+	adblockDomainPattern = regexp.MustCompile(`^[a-z0-9._*-]+$`)
+	// element hiding and scriptlet rules, e.g. `example.com##.ad`
+	adblockCosmetic = regexp.MustCompile(`#[@?$%]?#`)
+)
+
+// parseAdblockLine parses a line of an Adblock Plus style filter list, as used
+// by DNS blockers:
+//
+//	||example.com^     example.com and its subdomains (d;;example.com)
+//	|example.com^      exactly example.com (e;;example.com)
+//	example            any domain containing `example` (c;;example)
+//	ads*.example.com^  wildcards, as a regular expression
+//	/^ads[0-9]+\./     a regular expression
+//	@@||example.com^   an exception (whitelist) rule
+//	! comment
+//
+// The `$dnstype=AAAA|HTTPS` modifier limits a rule to query types, as the
+// `qtype` rule option does. Cosmetic filters, URL paths and modifiers other
+// than it and `$important` only make sense to browsers, so lines with them are
+// rejected.
+func parseAdblockLine(text string) ([]IRule, []Record, error) {
+	text = strings.TrimSpace(text)
+
+	if text == "" || text[0] == '!' || text[0] == '[' {
+		return nil, nil, nil
+	}
+
+	if match := adblockCosmetic.FindString(text); match != "" {
+		return nil, nil, errorAt(match, errors.New("cosmetic filters cannot be applied to DNS"))
+	}
+
+	if text[0] == '#' {
+		return nil, nil, nil
+	}
+
+	whitelist := strings.HasPrefix(text, adblockWhitelistPrefix)
+	text = strings.TrimPrefix(text, adblockWhitelistPrefix)
+
+	pattern, modifiers := text, ""
+
+	if strings.HasPrefix(text, "/") && strings.LastIndex(text, "/") > 0 {
+		i := strings.LastIndex(text, "/")
+		pattern, modifiers = text[:i+1], text[i+1:]
+	} else if i := strings.LastIndex(text, "$"); i >= 0 {
+		pattern, modifiers = text[:i], text[i:]
+	}
+
+	var options Options
+
+	if modifiers != "" {
+		if modifiers[0] != '$' {
+			return nil, nil, errorAt(modifiers, errors.New("text after a regular expression must be modifiers"))
+		}
+
+		for _, v := range strings.Split(modifiers[1:], ",") {
+			if strings.HasPrefix(v, adblockDNSType) {
+				if strings.Contains(v, "~") {
+					return nil, nil, errorAt(v, errors.New("excluded query types cannot be matched"))
+				}
+
+				types, err := ParseQueryTypes(v[len(adblockDNSType):])
+				if err != nil {
+					return nil, nil, errorAt(v, err)
+				}
+
+				options.Types = types
+			} else if v != "important" {
+				return nil, nil, errorAt(modifiers, fmt.Errorf("modifier `$%v` cannot be applied to DNS", v))
+			}
+		}
+	}
+
+	rule, err := adblockRule(pattern, whitelist)
+	if err != nil {
+		return nil, nil, errorAt(pattern, err)
+	}
+
+	if options != (Options{}) {
+		rule = optionsRule{rule, options}
+	}
+
+	return []IRule{rule}, nil, nil
+}
+
+// adblockRule converts an Adblock pattern, without its exception prefix or
+// modifiers, into the simplest rule that matches the same domains.
+func adblockRule(pattern string, whitelist bool) (IRule, error) {
+	if len(pattern) > 1 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		expression, err := regexp.Compile(pattern[1 : len(pattern)-1])
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %v", err)
+		}
+
+		return regexpRule{expression, whitelist}, nil
+	}
+
+	anchor := ""
+	if strings.HasPrefix(pattern, adblockDomainAnchor) {
+		anchor, pattern = adblockDomainAnchor, pattern[len(adblockDomainAnchor):]
+	} else if strings.HasPrefix(pattern, adblockAnchor) {
+		anchor, pattern = adblockAnchor, pattern[len(adblockAnchor):]
+	}
+
+	end := false
+	for strings.HasSuffix(pattern, adblockSeparator) || strings.HasSuffix(pattern, adblockAnchor) {
+		end, pattern = true, pattern[:len(pattern)-1]
+	}
+
+	pattern = strings.ToLower(pattern)
+
+	if pattern == "" || pattern == "*" {
+		return nil, errors.New("pattern matches every domain")
+	}
+
+	if strings.ContainsAny(pattern, adblockSeparator+adblockAnchor) {
+		return nil, errors.New("separators inside a pattern cannot be matched against a domain")
+	}
+
+	if !adblockDomainPattern.MatchString(pattern) {
+		return nil, errors.New("URL patterns cannot be matched against a domain")
+	}
+
+	if !strings.Contains(pattern, "*") {
+		switch {
+		case anchor == adblockDomainAnchor && end:
+			return suffixRule{strings.TrimPrefix(pattern, "."), whitelist}, nil
+		case anchor == adblockAnchor && end:
+			return equalsRule{pattern, whitelist}, nil
+		case anchor == "" && !end:
+			return containsRule{pattern, whitelist}, nil
+		}
+	}
+
+	var b strings.Builder
+
+	switch anchor {
+	case adblockDomainAnchor:
+		b.WriteString(`(^|\.)`)
+	case adblockAnchor:
+		b.WriteString("^")
+	}
+
+	for k, v := range strings.Split(pattern, "*") {
+		if k > 0 {
+			b.WriteString(".*")
+		}
+
+		b.WriteString(regexp.QuoteMeta(v))
+	}
+
+	if end {
+		b.WriteString("$")
+	}
+
+	return regexpRule{regexp.MustCompile(b.String()), whitelist}, nil
+}
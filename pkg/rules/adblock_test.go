@@ -0,0 +1,118 @@
+package rules
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestAdblockLines(t *testing.T) {
+	cases := map[string]string{
+		"||example.com^":                    "d;;example.com",
+		"||Example.com^$important":          "d;;example.com",
+		"@@||safe.example.com^":             "d;w;safe.example.com",
+		"|exact.example.com^":               "e;;exact.example.com",
+		"|exact.example.com|":               "e;;exact.example.com",
+		"tracker":                           "c;;tracker",
+		"@@allowed":                         "c;w;allowed",
+		"||ads*.example.com^":               `r;;(^|\.)ads.*\.example\.com$`,
+		"||example.com":                     `r;;(^|\.)example\.com`,
+		"example.com^":                      `r;;example\.com$`,
+		"/^ad[0-9]+\\./":                    `r;;^ad[0-9]+\.`,
+		"/^ad[0-9]+\\./$important":          `r;;^ad[0-9]+\.`,
+		"@@|*.cdn.example.net^":             `r;w;^.*\.cdn\.example\.net$`,
+		"  ||padded.example.com^   ":        "d;;padded.example.com",
+		"||example.com^$dnstype=https|aaaa": "d;qtype=AAAA|HTTPS;example.com",
+		"@@tracker$important,dnstype=A":     "c;w,qtype=A;tracker",
+	}
+
+	for line, expected := range cases {
+		parsed, _, err := parseAdblockLine(line)
+		if err != nil {
+			t.Fatalf("line '%v' gave error: %v", line, err)
+		}
+
+		if len(parsed) != 1 || parsed[0].String() != expected {
+			t.Fatalf("line '%v' was parsed as %v, expected '%v'", line, parsed, expected)
+		}
+	}
+
+	for _, line := range []string{"", "! comment", "[Adblock Plus 2.0]", "# comment"} {
+		if parsed, _, err := parseAdblockLine(line); err != nil || len(parsed) != 0 {
+			t.Fatalf("line '%v' was not skipped: %v %v", line, parsed, err)
+		}
+	}
+
+	for _, line := range []string{
+		"example.com##.advert",
+		"##.advert",
+		"example.com#@#.advert",
+		"||example.com^$script",
+		"||example.com^$third-party,important",
+		"||example.com^$dnstype=~A",
+		"||example.com^$dnstype=BOGUS",
+		"||example.com/ads/banner.png",
+		"||example.com^*/path",
+		"/[unclosed/",
+		"*",
+		"||^",
+	} {
+		if _, _, err := parseAdblockLine(line); err == nil {
+			t.Fatalf("no error for line '%v', which cannot apply to DNS", line)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	cases := []struct {
+		path     string
+		lines    []string
+		expected Format
+	}{
+		{"rules", []string{"e;;example.com"}, FormatDNSFSD},
+		{"list.abp", []string{"||example.com^"}, FormatAdblock},
+		{"list.txt", []string{"[Adblock Plus 2.0]", "||example.com^"}, FormatAdblock},
+		{"list.txt", []string{"", "# my list", "# format: adblock", "||example.com^"}, FormatAdblock},
+		{"list.abp", []string{"#format: dnsfsd", "e;;example.com"}, FormatDNSFSD},
+		{"list.txt", []string{"e;;example.com", "# format: adblock"}, FormatDNSFSD},
+		{"list.txt", []string{"# format: nonsense"}, FormatDNSFSD},
+	}
+
+	for _, v := range cases {
+		if format := DetectFormat(v.path, v.lines); format != v.expected {
+			t.Fatalf("'%v' %v was detected as %v, expected %v", v.path, v.lines, format, v.expected)
+		}
+	}
+}
+
+func TestLoadAdblock(t *testing.T) {
+	filepath := path.Join(t.TempDir(), "list.txt")
+	data := "[Adblock Plus 2.0]\n! Title: test\n||ads.example.com^\nexample.com##.banner\n@@||good.ads.example.com^\n||example.org^$script\n"
+
+	if err := ioutil.WriteFile(filepath, []byte(data), 0644); err != nil {
+		t.Fatalf("could not write rule file: %v", err)
+	}
+
+	file := RuleFile{Path: filepath}
+	if err := file.Load(); err != nil {
+		t.Fatalf("could not load adblock file: %v", err)
+	}
+
+	if file.Format != FormatAdblock || len(*file.Rules) != 2 {
+		t.Fatalf("file loaded as %v with %v rules, expected adblock with 2", file.Format, len(*file.Rules))
+	}
+
+	if (*file.Lines)[1] != 5 {
+		t.Fatalf("exception rule reported on line %v, expected 5", (*file.Lines)[1])
+	}
+
+	diagnostics := *file.Diagnostics
+	if len(diagnostics) != 2 || diagnostics[0].Line != 4 || diagnostics[1].Line != 6 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+
+	set := CollectAllRules(&[]RuleFile{file})
+	if !set.Test("x.ads.example.com") || set.Test("good.ads.example.com") {
+		t.Fatalf("adblock rules did not match as expected")
+	}
+}
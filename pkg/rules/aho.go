@@ -0,0 +1,147 @@
+package rules
+
+import "sort"
+
+type acEdge struct {
+	char byte
+	node int32
+}
+
+type acNode struct {
+	edges  []acEdge // sorted by char once built
+	fail   int32    // longest proper suffix of this node that is in the trie
+	output int32    // index of the pattern ending at this node, or -1
+	dict   int32    // nearest node on the fail chain with an output, or -1
+}
+
+// ahoCorasick is an Aho-Corasick automaton, which finds every occurrence of a
+// set of patterns in a text with a single pass over the text. Matching time
+// depends on the length of the text and the number of matches rather than the
+// number of patterns.
+type ahoCorasick struct {
+	nodes []acNode
+}
+
+func (a *ahoCorasick) next(node int32, char byte) (int32, bool) {
+	edges := a.nodes[node].edges
+	i := sort.Search(len(edges), func(i int) bool {
+		return edges[i].char >= char
+	})
+
+	if i < len(edges) && edges[i].char == char {
+		return edges[i].node, true
+	}
+
+	return 0, false
+}
+
+// newAhoCorasick builds an automaton for a set of patterns. The index of a
+// pattern in the slice is what is given to the callback of match.
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	a := &ahoCorasick{nodes: []acNode{{output: -1, dict: -1}}}
+
+	for k, pattern := range patterns {
+		var node int32
+
+		for i := 0; i < len(pattern); i++ {
+			child, ok := a.next(node, pattern[i])
+
+			if !ok {
+				child = int32(len(a.nodes))
+				a.nodes = append(a.nodes, acNode{output: -1, dict: -1})
+				a.nodes[node].edges = insertEdge(a.nodes[node].edges, acEdge{pattern[i], child})
+			}
+
+			node = child
+		}
+
+		a.nodes[node].output = int32(k)
+	}
+
+	// breadth first, so the fail links of shallower nodes are always ready
+	queue := make([]int32, 0, len(a.nodes))
+
+	for _, e := range a.nodes[0].edges {
+		queue = append(queue, e.node)
+	}
+
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+
+		for _, e := range a.nodes[node].edges {
+			fail := a.nodes[node].fail
+
+			for {
+				if next, ok := a.next(fail, e.char); ok {
+					fail = next
+					break
+				}
+
+				if fail == 0 {
+					break
+				}
+
+				fail = a.nodes[fail].fail
+			}
+
+			child := &a.nodes[e.node]
+			child.fail = fail
+
+			if a.nodes[fail].output >= 0 {
+				child.dict = fail
+			} else {
+				child.dict = a.nodes[fail].dict
+			}
+
+			queue = append(queue, e.node)
+		}
+	}
+
+	return a
+}
+
+func insertEdge(edges []acEdge, edge acEdge) []acEdge {
+	i := sort.Search(len(edges), func(i int) bool {
+		return edges[i].char >= edge.char
+	})
+
+	edges = append(edges, acEdge{})
+	copy(edges[i+1:], edges[i:])
+	edges[i] = edge
+
+	return edges
+}
+
+// match calls fn with the index of every pattern found in text, stopping as
+// soon as fn returns true. It returns whether fn stopped the match.
+func (a *ahoCorasick) match(text string, fn func(pattern int) bool) bool {
+	if a.nodes[0].output >= 0 && fn(int(a.nodes[0].output)) { // the empty pattern
+		return true
+	}
+
+	var node int32
+
+	for i := 0; i < len(text); i++ {
+		for {
+			if next, ok := a.next(node, text[i]); ok {
+				node = next
+				break
+			}
+
+			if node == 0 {
+				break
+			}
+
+			node = a.nodes[node].fail
+		}
+
+		for out := node; out > 0; out = a.nodes[out].dict {
+			if a.nodes[out].output >= 0 && fn(int(a.nodes[out].output)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
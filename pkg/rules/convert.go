@@ -0,0 +1,76 @@
+package rules
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ConversionSummary counts what happened to each line of a converted rule
+// file.
+type ConversionSummary struct {
+	Converted   int          // Lines that gave at least one rule
+	Skipped     int          // Blank lines and comments
+	Rejected    int          // Lines that could not be expressed as rules
+	Rules       int          // Rules written
+	Diagnostics []Diagnostic // Why each rejected line was rejected
+}
+
+func (s ConversionSummary) String() string {
+	return fmt.Sprintf("%v lines converted to %v rules, %v skipped, %v rejected", s.Converted, s.Rules, s.Skipped, s.Rejected)
+}
+
+// Convert reads a rule file in a given format from in and writes it to out as
+// canonical dnsfsd `t;w;rule` lines. name is only used in diagnostics. Local
+// records, from hosts files, cannot be written as rules and are rejected.
+func Convert(in io.Reader, out io.Writer, from Format, name string) (ConversionSummary, error) {
+	var summary ConversionSummary
+	parse, ok := parsers[from]
+
+	if !ok {
+		return summary, fmt.Errorf("unknown rule file format `%v`", from)
+	}
+
+	scanner := bufio.NewScanner(in)
+	writer := bufio.NewWriter(out)
+
+	if _, err := fmt.Fprintf(writer, "# converted from %v by dnsfs convert\n", from); err != nil {
+		return summary, err
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		rules, records, err := parse(text)
+
+		if err == nil && len(records) > 0 {
+			err = errors.New("local records cannot be written as dnsfsd rules")
+		}
+
+		if err != nil {
+			summary.Rejected++
+			summary.Diagnostics = append(summary.Diagnostics, newDiagnostic(name, line, text, err))
+			continue
+		}
+
+		if len(rules) == 0 {
+			summary.Skipped++
+			continue
+		}
+
+		summary.Converted++
+		summary.Rules += len(rules)
+
+		for _, v := range rules {
+			if _, err := fmt.Fprintln(writer, v); err != nil {
+				return summary, err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return summary, err
+	}
+
+	return summary, writer.Flush()
+}
@@ -0,0 +1,41 @@
+package rules
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	in := "# hosts\n\n0.0.0.0 ads.example.com tracker.example.com\n192.168.1.2 nas.home\nnot-an-ip example.com\n127.0.0.1 localhost\n"
+	var out bytes.Buffer
+
+	summary, err := Convert(strings.NewReader(in), &out, FormatHosts, "stdin")
+	if err != nil {
+		t.Fatalf("could not convert: %v", err)
+	}
+
+	expected := "# converted from hosts by dnsfs convert\ne;;ads.example.com\ne;;tracker.example.com\n"
+	if out.String() != expected {
+		t.Fatalf("converted to '%v', expected '%v'", out.String(), expected)
+	}
+
+	if summary.Converted != 1 || summary.Rules != 2 || summary.Skipped != 3 || summary.Rejected != 2 {
+		t.Fatalf("unexpected summary: %v", summary)
+	}
+
+	if summary.Diagnostics[0].Line != 4 || summary.Diagnostics[1].Line != 5 || summary.Diagnostics[1].Path != "stdin" {
+		t.Fatalf("unexpected diagnostics: %v", summary.Diagnostics)
+	}
+
+	// the output must load back as the same rules
+	for _, v := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if _, err := RuleFromString(v); err != nil {
+			t.Fatalf("converted line '%v' does not parse: %v", v, err)
+		}
+	}
+
+	if _, err := Convert(strings.NewReader(in), &out, Format("nonsense"), "stdin"); err == nil {
+		t.Fatalf("no error for an unknown format")
+	}
+}
@@ -0,0 +1,127 @@
+package rules
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// parseDNSCryptLine parses a line of a dnscrypt-proxy blocked names file:
+//
+//	example.com    example.com and its subdomains (d;;example.com)
+//	*.example.com  the same
+//	=example.com   exactly example.com (e;;example.com)
+//	*track*        any domain containing `track` (c;;track)
+//	ads.*          wildcards, as a regular expression
+//	# comment
+//
+// Time restrictions (`example.com @work`) cannot be followed, so lines with
+// them are rejected.
+func parseDNSCryptLine(text string) ([]IRule, []Record, error) {
+	if i := strings.IndexByte(text, '#'); i >= 0 {
+		text = text[:i]
+	}
+
+	fields := strings.Fields(strings.ToLower(text))
+
+	if len(fields) == 0 {
+		return nil, nil, nil
+	}
+
+	if len(fields) > 1 {
+		if strings.HasPrefix(fields[1], "@") {
+			return nil, nil, errorAt(fields[1], errors.New("time restrictions are not supported"))
+		}
+
+		return nil, nil, errorAt(fields[1], errors.New("a line must hold a single pattern"))
+	}
+
+	pattern := fields[0]
+
+	if strings.HasPrefix(pattern, "=") {
+		pattern = pattern[1:]
+
+		if pattern == "" || strings.Contains(pattern, "*") {
+			return nil, nil, errorAt(fields[0], errors.New("an exact match must be a domain"))
+		}
+
+		return []IRule{equalsRule{pattern, false}}, nil, nil
+	}
+
+	// `*.example.com` is the same as `example.com`, but patterns with more
+	// wildcards, such as `*.ads.*`, are left whole
+	if suffix := strings.TrimPrefix(pattern, "*."); suffix != pattern && !strings.Contains(suffix, "*") {
+		pattern = suffix
+	}
+
+	rule, err := globRule(pattern, false)
+	if err != nil {
+		return nil, nil, errorAt(pattern, err)
+	}
+
+	return []IRule{rule}, nil, nil
+}
+
+// globRule converts a dnscrypt-proxy style pattern into the simplest rule that
+// matches the same domains:
+//
+//	example.com     example.com and its subdomains
+//	*ads*, *.ads.*  any domain containing the text between the stars
+//	*.ad*.com       a domain ending in a match of ad*.com
+//	ads.*           any domain starting with ads.
+//	ad*.example.com a domain matching the whole pattern
+//
+// A `*` that is not a whole label at either end of the pattern matches any
+// text within a label.
+func globRule(pattern string, whitelist bool) (IRule, error) {
+	trimmed := strings.Trim(pattern, "*")
+
+	if trimmed == "" || strings.Trim(trimmed, ".") == "" {
+		return nil, errors.New("pattern matches every domain")
+	}
+
+	if !strings.Contains(pattern, "*") {
+		return suffixRule{strings.TrimPrefix(pattern, "."), whitelist}, nil
+	}
+
+	substring := strings.HasPrefix(pattern, "*") && strings.HasSuffix(pattern, "*")
+
+	if substring && !strings.Contains(trimmed, "*") {
+		return containsRule{trimmed, whitelist}, nil
+	}
+
+	var b strings.Builder
+	body := trimmed
+
+	if !substring {
+		body = pattern
+		b.WriteString("^")
+
+		if strings.HasPrefix(body, "*.") {
+			body = body[2:]
+			b.WriteString(`(.*\.)?`)
+		}
+	}
+
+	prefix := !substring && strings.HasSuffix(body, ".*")
+	if prefix {
+		body = body[:len(body)-2]
+	}
+
+	for k, v := range strings.Split(body, "*") {
+		if k > 0 {
+			b.WriteString(`[^.]*`)
+		}
+
+		b.WriteString(regexp.QuoteMeta(v))
+	}
+
+	switch {
+	case prefix:
+		b.WriteString(`\.`)
+	case !substring:
+		b.WriteString("$")
+	}
+
+	return regexpRule{regexp.MustCompile(b.String()), whitelist}, nil
+}
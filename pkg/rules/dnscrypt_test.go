@@ -0,0 +1,70 @@
+package rules
+
+import "testing"
+
+func TestDNSCryptLines(t *testing.T) {
+	cases := map[string]string{
+		"example.com":           "d;;example.com",
+		"*.Example.com":         "d;;example.com",
+		"=exact.example.com":    "e;;exact.example.com",
+		"*track*":               "c;;track",
+		"ads.*":                 `r;;^ads\.`,
+		"*.ads.*":               "c;;.ads.",
+		"*ad*track*":            `r;;ad[^.]*track`,
+		"ad*.example.com":       `r;;^ad[^.]*\.example\.com$`,
+		"*-ads.example.com":     `r;;^[^.]*-ads\.example\.com$`,
+		"*.ad*.example.com":     `r;;^(.*\.)?ad[^.]*\.example\.com$`,
+		"ad*.*":                 `r;;^ad[^.]*\.`,
+		"  spaced.example.com ": "d;;spaced.example.com",
+		"inline.example # note": "d;;inline.example",
+	}
+
+	for line, expected := range cases {
+		parsed, _, err := parseDNSCryptLine(line)
+		if err != nil {
+			t.Fatalf("line '%v' gave error: %v", line, err)
+		}
+
+		if len(parsed) != 1 || parsed[0].String() != expected {
+			t.Fatalf("line '%v' was parsed as %v, expected '%v'", line, parsed, expected)
+		}
+	}
+
+	matches := []struct {
+		pattern string
+		domain  string
+		match   bool
+	}{
+		{"*.ads.*", "tracker.ads.example", true},
+		{"*.ads.*", "badads.example", false},
+		{"*-ads.example.com", "my-ads.example.com", true},
+		{"*-ads.example.com", "a.my-ads.example.com", false},
+		{"*-ads.example.com", "my-ads.example.com.evil", false},
+		{"ad*.example.com", "ad.b.example.com", false},
+		{"*.ad*.example.com", "x.ad1.example.com", true},
+		{"ads.*", "ads.example.com", true},
+	}
+
+	for _, v := range matches {
+		parsed, _, err := parseDNSCryptLine(v.pattern)
+		if err != nil {
+			t.Fatalf("line '%v' gave error: %v", v.pattern, err)
+		}
+
+		if parsed[0].Match(v.domain) != v.match {
+			t.Fatalf("pattern '%v' matching '%v' gave %v, expected %v", v.pattern, v.domain, !v.match, v.match)
+		}
+	}
+
+	for _, line := range []string{"", "# comment", "   "} {
+		if parsed, _, err := parseDNSCryptLine(line); err != nil || len(parsed) != 0 {
+			t.Fatalf("line '%v' was not skipped: %v %v", line, parsed, err)
+		}
+	}
+
+	for _, line := range []string{"example.com @work", "a.example b.example", "*", "*.*", "=", "=*.example.com"} {
+		if _, _, err := parseDNSCryptLine(line); err == nil {
+			t.Fatalf("no error for invalid line '%v'", line)
+		}
+	}
+}
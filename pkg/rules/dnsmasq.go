@@ -0,0 +1,74 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseDnsmasqLine parses a line of a dnsmasq configuration file used as a
+// blocklist:
+//
+//	address=/example.com/0.0.0.0  example.com and its subdomains (d;;example.com)
+//	address=/example.com/         the same, answered with NXDOMAIN (d;sink=nxdomain;example.com)
+//	server=/example.com/          the same, as no server is given to forward to
+//	local=/a.example/b.example/   several domains at once
+//	# comment
+//
+// Addresses other than sink addresses answer every subdomain too, which local
+// records cannot, so lines with them are rejected along with any other option.
+func parseDnsmasqLine(text string) ([]IRule, []Record, error) {
+	text = strings.TrimSpace(text)
+
+	if text == "" || text[0] == '#' {
+		return nil, nil, nil
+	}
+
+	split := strings.SplitN(text, "=", 2)
+	option := strings.ToLower(strings.TrimSpace(split[0]))
+
+	if option != "address" && option != "server" && option != "local" {
+		return nil, nil, errorAt(text, fmt.Errorf("option `%v` is not a blocking option", option))
+	}
+
+	if len(split) != 2 || !strings.HasPrefix(split[1], "/") || strings.Count(split[1], "/") < 2 {
+		return nil, nil, errorAt(split[len(split)-1], errors.New("expected a `/domain/` list"))
+	}
+
+	i := strings.LastIndexByte(split[1], '/')
+	domains, target := strings.Split(split[1][1:i], "/"), strings.TrimSpace(split[1][i+1:])
+	options := Options{Sink: SinkNXDomain}
+
+	if target != "" {
+		if option != "address" {
+			return nil, nil, errorAt(target, fmt.Errorf("`%v` lines that forward to a server are not blocks", option))
+		}
+
+		if ip := net.ParseIP(target); target != "#" && (ip == nil || !isSinkAddress(ip)) {
+			return nil, nil, errorAt(target, fmt.Errorf("address %v is not a sink address", target))
+		}
+
+		options = Options{}
+	}
+
+	rules := make([]IRule, 0, len(domains))
+
+	for _, v := range domains {
+		domain := strings.Trim(strings.ToLower(v), ".")
+
+		if domain == "" || domain == "#" {
+			return nil, nil, errorAt(split[1], errors.New("blocking every domain is not supported"))
+		}
+
+		var rule IRule = suffixRule{domain, false}
+
+		if options != (Options{}) {
+			rule = optionsRule{rule, options}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil, nil
+}
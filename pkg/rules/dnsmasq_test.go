@@ -0,0 +1,51 @@
+package rules
+
+import "testing"
+
+func TestDnsmasqLines(t *testing.T) {
+	cases := map[string][]string{
+		"address=/example.com/0.0.0.0":       {"d;;example.com"},
+		"address=/example.com/::":            {"d;;example.com"},
+		"address=/example.com/#":             {"d;;example.com"},
+		"address=/Example.com/":              {"d;sink=nxdomain;example.com"},
+		"server=/example.com/":               {"d;sink=nxdomain;example.com"},
+		"local=/a.example/.b.example./":      {"d;sink=nxdomain;a.example", "d;sink=nxdomain;b.example"},
+		"  address=/padded.example/0.0.0.0 ": {"d;;padded.example"},
+	}
+
+	for line, expected := range cases {
+		parsed, _, err := parseDnsmasqLine(line)
+		if err != nil {
+			t.Fatalf("line '%v' gave error: %v", line, err)
+		}
+
+		if len(parsed) != len(expected) {
+			t.Fatalf("line '%v' was parsed as %v, expected %v", line, parsed, expected)
+		}
+
+		for k, v := range parsed {
+			if v.String() != expected[k] {
+				t.Fatalf("line '%v' was parsed as %v, expected %v", line, parsed, expected)
+			}
+		}
+	}
+
+	for _, line := range []string{"", "# comment"} {
+		if parsed, _, err := parseDnsmasqLine(line); err != nil || len(parsed) != 0 {
+			t.Fatalf("line '%v' was not skipped: %v %v", line, parsed, err)
+		}
+	}
+
+	for _, line := range []string{
+		"address=/example.com/192.168.1.1",
+		"server=/example.com/1.1.1.1",
+		"address=/#/",
+		"address=example.com",
+		"cache-size=1000",
+		"domain-needed",
+	} {
+		if _, _, err := parseDnsmasqLine(line); err == nil {
+			t.Fatalf("no error for line '%v', which is not a block", line)
+		}
+	}
+}
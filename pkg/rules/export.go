@@ -0,0 +1,299 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FormatUnbound is Unbound `local-zone` and `local-data` statements. Rules can
+// be exported to it but not loaded from it.
+const FormatUnbound Format = "unbound"
+
+// ruleExporter gives the lines a rule is written as in another format. If the
+// rule cannot be written exactly, the reason is given as a warning; lines may
+// still be given for a rule that is only approximated.
+type ruleExporter func(rule IRule) (lines []string, warning string)
+
+// recordExporter gives the lines a local record is written as in another
+// format, or a warning if it cannot be written.
+type recordExporter func(record Record) (lines []string, warning string)
+
+// exporter writes a format. Rules limited to query types are skipped unless
+// the format can hold them too.
+type exporter struct {
+	header string
+	rule   ruleExporter
+	record recordExporter
+	types  bool
+}
+
+var exporters = map[Format]exporter{
+	FormatHosts:   {"# exported by dnsfs export", exportHostsRule, exportHostsRecord, false},
+	FormatAdblock: {"! exported by dnsfs export", exportAdblockRule, exportAdblockRecord, true},
+	FormatDnsmasq: {"# exported by dnsfs export", exportDnsmasqRule, exportDnsmasqRecord, false},
+	FormatUnbound: {"# exported by dnsfs export\nserver:", exportUnboundRule, exportUnboundRecord, false},
+}
+
+// ParseExportFormat returns the Format named by text that rules can be
+// exported to, or an error if there is no such format.
+func ParseExportFormat(text string) (Format, error) {
+	format := Format(strings.ToLower(strings.TrimSpace(text)))
+
+	if _, ok := exporters[format]; !ok {
+		return "", fmt.Errorf("cannot export to rule file format `%v`", text)
+	}
+
+	return format, nil
+}
+
+// ExportWarning reports a rule or local record that could not be written
+// exactly in the format exported to.
+type ExportWarning struct {
+	Item    fmt.Stringer // The rule or record
+	Source  RuleSource   // Where a rule was loaded from
+	Skipped bool         // Whether it was left out, rather than approximated
+	Reason  string
+}
+
+func (w ExportWarning) String() string {
+	verb := "approximated"
+	if w.Skipped {
+		verb = "skipped"
+	}
+
+	if _, ok := w.Item.(Record); ok {
+		return fmt.Sprintf("%v record '%v': %v", verb, w.Item, w.Reason)
+	}
+
+	return fmt.Sprintf("%v rule '%v' (%v): %v", verb, w.Item, w.Source, w.Reason)
+}
+
+// Export writes the rules and local records of a RuleSet to out in another
+// blocker's format, returning how many rules were written, skipped rules aside,
+// and a warning for each rule or record that could not be written exactly.
+func Export(set *RuleSet, out io.Writer, to Format) (int, []ExportWarning, error) {
+	e, ok := exporters[to]
+
+	if !ok {
+		return 0, nil, fmt.Errorf("cannot export to rule file format `%v`", to)
+	}
+
+	writer := bufio.NewWriter(out)
+	warnings := make([]ExportWarning, 0)
+	written := 0
+
+	write := func(lines []string) error {
+		for _, v := range lines {
+			if _, err := fmt.Fprintln(writer, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := write([]string{e.header}); err != nil {
+		return written, warnings, err
+	}
+
+	for _, v := range set.Rules() {
+		if RuleOptions(v).Types != "" && !e.types {
+			source, _ := set.Source(v)
+			warnings = append(warnings, ExportWarning{v, source, true, fmt.Sprintf(warnQueryTypes, to)})
+
+			continue
+		}
+
+		lines, warning := e.rule(v)
+
+		if warning != "" {
+			source, _ := set.Source(v)
+			warnings = append(warnings, ExportWarning{v, source, len(lines) == 0, warning})
+		}
+
+		if err := write(lines); err != nil {
+			return written, warnings, err
+		}
+
+		if len(lines) > 0 {
+			written++
+		}
+	}
+
+	for _, v := range set.Records() {
+		lines, warning := e.record(v)
+
+		if warning != "" {
+			warnings = append(warnings, ExportWarning{v, RuleSource{}, len(lines) == 0, warning})
+		}
+
+		if err := write(lines); err != nil {
+			return written, warnings, err
+		}
+	}
+
+	return written, warnings, writer.Flush()
+}
+
+// sinkWarning returns the warning for a rule whose sink mode cannot be written
+// in a format, which answers as the given modes do, or "" if it can.
+func sinkWarning(rule IRule, to Format, modes ...SinkMode) string {
+	mode := RuleOptions(rule).Sink
+
+	if rule.Whitelist() || mode == SinkDefault {
+		return ""
+	}
+
+	for _, v := range modes {
+		if mode == v {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf(warnSinkMode, to)
+}
+
+// joinWarnings joins the warnings that are not "".
+func joinWarnings(warnings ...string) string {
+	parts := make([]string, 0, len(warnings))
+
+	for _, v := range warnings {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+const (
+	warnWhitelist  = "%v cannot hold exceptions"
+	warnSubdomains = "%v cannot block subdomains, only the domain itself is blocked"
+	warnExact      = "%v cannot match a domain without its subdomains"
+	warnPattern    = "%v cannot match patterns"
+	warnSinkMode   = "%v cannot choose the sink response, the default is used"
+	warnQueryTypes = "%v cannot limit a rule to query types"
+)
+
+func exportHostsRule(rule IRule) ([]string, string) {
+	if rule.Whitelist() {
+		return nil, fmt.Sprintf(warnWhitelist, FormatHosts)
+	}
+
+	// hosts files answer with 0.0.0.0
+	warning := sinkWarning(rule, FormatHosts, SinkNullIP)
+
+	switch r := baseRule(rule).(type) {
+	case equalsRule:
+		return []string{"0.0.0.0 " + r.str}, warning
+	case suffixRule:
+		return []string{"0.0.0.0 " + r.domain}, joinWarnings(fmt.Sprintf(warnSubdomains, FormatHosts), warning)
+	default:
+		return nil, fmt.Sprintf(warnPattern, FormatHosts)
+	}
+}
+
+func exportHostsRecord(record Record) ([]string, string) {
+	return []string{record.String()}, ""
+}
+
+func exportAdblockRule(rule IRule) ([]string, string) {
+	prefix := ""
+	if rule.Whitelist() {
+		prefix = adblockWhitelistPrefix
+	}
+
+	warning := sinkWarning(rule, FormatAdblock)
+
+	modifiers := ""
+	if types := RuleOptions(rule).Types; types != "" {
+		modifiers = "$" + adblockDNSType + string(types)
+	}
+
+	switch r := baseRule(rule).(type) {
+	case equalsRule:
+		return []string{prefix + adblockAnchor + r.str + adblockSeparator + modifiers}, warning
+	case suffixRule:
+		return []string{prefix + adblockDomainAnchor + r.domain + adblockSeparator + modifiers}, warning
+	case containsRule:
+		return []string{prefix + r.substring + modifiers}, warning
+	case regexpRule:
+		return []string{prefix + "/" + r.expression.String() + "/" + modifiers}, warning
+	default:
+		return nil, fmt.Sprintf(warnPattern, FormatAdblock)
+	}
+}
+
+func exportAdblockRecord(record Record) ([]string, string) {
+	return nil, "adblock lists cannot hold local records"
+}
+
+func exportDnsmasqRule(rule IRule) ([]string, string) {
+	r, ok := baseRule(rule).(suffixRule)
+
+	switch {
+	case ok && rule.Whitelist():
+		return []string{"server=/" + r.domain + "/#"}, ""
+	case ok && RuleOptions(rule).Sink == SinkNXDomain:
+		return []string{"address=/" + r.domain + "/"}, ""
+	case ok:
+		// `#` answers with 0.0.0.0 and ::
+		return []string{"address=/" + r.domain + "/#"}, sinkWarning(rule, FormatDnsmasq, SinkNullIP)
+	}
+
+	if _, exact := baseRule(rule).(equalsRule); exact {
+		return nil, fmt.Sprintf(warnExact, FormatDnsmasq)
+	}
+
+	return nil, fmt.Sprintf(warnPattern, FormatDnsmasq)
+}
+
+func exportDnsmasqRecord(record Record) ([]string, string) {
+	return []string{fmt.Sprintf("host-record=%v,%v", record.Domain, record.IP)}, ""
+}
+
+// unboundZoneTypes are the Unbound local-zone types that answer as each sink
+// mode does.
+var unboundZoneTypes = map[SinkMode]string{
+	SinkDefault:  "always_null",
+	SinkNullIP:   "always_null",
+	SinkNXDomain: "always_nxdomain",
+	SinkRefused:  "always_refuse",
+}
+
+func exportUnboundRule(rule IRule) ([]string, string) {
+	switch r := baseRule(rule).(type) {
+	case equalsRule:
+		if rule.Whitelist() {
+			return nil, fmt.Sprintf(warnExact, FormatUnbound)
+		}
+
+		return []string{
+			fmt.Sprintf("    local-data: \"%v. A 0.0.0.0\"", r.str),
+			fmt.Sprintf("    local-data: \"%v. AAAA ::\"", r.str),
+		}, sinkWarning(rule, FormatUnbound, SinkNullIP)
+	case suffixRule:
+		if rule.Whitelist() {
+			return []string{fmt.Sprintf("    local-zone: \"%v.\" transparent", r.domain)}, ""
+		}
+
+		if zone, ok := unboundZoneTypes[RuleOptions(rule).Sink]; ok {
+			return []string{fmt.Sprintf("    local-zone: \"%v.\" %v", r.domain, zone)}, ""
+		}
+
+		return []string{fmt.Sprintf("    local-zone: \"%v.\" always_null", r.domain)}, fmt.Sprintf(warnSinkMode, FormatUnbound)
+	default:
+		return nil, fmt.Sprintf(warnPattern, FormatUnbound)
+	}
+}
+
+func exportUnboundRecord(record Record) ([]string, string) {
+	rrtype := "A"
+	if record.IP.To4() == nil {
+		rrtype = "AAAA"
+	}
+
+	return []string{fmt.Sprintf("    local-data: \"%v. %v %v\"", record.Domain, rrtype, record.IP)}, ""
+}
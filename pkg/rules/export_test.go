@@ -0,0 +1,158 @@
+package rules
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func exportTestSet(t *testing.T) *RuleSet {
+	lines := []string{
+		"e;;exact.example.com",
+		"d;;example.org",
+		"d;sink=nxdomain;nx.example.net",
+		"d;w;safe.example.org",
+		"c;;tracker",
+		`r;;^ad[0-9]+\.`,
+		"d;qtype=AAAA;v6.example.com",
+		"e;sink=refused;refused.example.com",
+	}
+
+	l := make([]IRule, 0, len(lines))
+	sources := make([]RuleSource, 0, len(lines))
+
+	for k, v := range lines {
+		rule, err := RuleFromString(v)
+		if err != nil {
+			t.Fatalf("could not parse rule '%v': %v", v, err)
+		}
+
+		l = append(l, rule)
+		sources = append(sources, RuleSource{"test", k + 1})
+	}
+
+	set := newRuleSet(l, sources)
+	set.SetRecords([]Record{{"nas.home", net.ParseIP("10.0.0.2")}, {"nas.home", net.ParseIP("fd00::2")}})
+
+	return set
+}
+
+func TestExport(t *testing.T) {
+	cases := map[Format]struct {
+		expected []string
+		written  int
+		warnings int
+	}{
+		FormatHosts: {[]string{
+			"0.0.0.0 exact.example.com",
+			"0.0.0.0 example.org",
+			"0.0.0.0 nx.example.net",
+			"0.0.0.0 refused.example.com",
+			"10.0.0.2 nas.home",
+			"fd00::2 nas.home",
+		}, 4, 7},
+		FormatAdblock: {[]string{
+			"|exact.example.com^",
+			"||example.org^",
+			"||nx.example.net^",
+			"@@||safe.example.org^",
+			"tracker",
+			`/^ad[0-9]+\./`,
+			"||v6.example.com^$dnstype=AAAA",
+			"|refused.example.com^",
+		}, 8, 4},
+		FormatDnsmasq: {[]string{
+			"address=/example.org/#",
+			"address=/nx.example.net/",
+			"server=/safe.example.org/#",
+			"host-record=nas.home,10.0.0.2",
+			"host-record=nas.home,fd00::2",
+		}, 3, 5},
+		FormatUnbound: {[]string{
+			"server:",
+			`    local-data: "exact.example.com. A 0.0.0.0"`,
+			`    local-data: "exact.example.com. AAAA ::"`,
+			`    local-zone: "example.org." always_null`,
+			`    local-zone: "nx.example.net." always_nxdomain`,
+			`    local-zone: "safe.example.org." transparent`,
+			`    local-data: "refused.example.com. A 0.0.0.0"`,
+			`    local-data: "refused.example.com. AAAA ::"`,
+			`    local-data: "nas.home. A 10.0.0.2"`,
+			`    local-data: "nas.home. AAAA fd00::2"`,
+		}, 5, 4},
+	}
+
+	set := exportTestSet(t)
+
+	for format, v := range cases {
+		var out bytes.Buffer
+
+		written, warnings, err := Export(set, &out, format)
+		if err != nil {
+			t.Fatalf("could not export to %v: %v", format, err)
+		}
+
+		if written != v.written {
+			t.Fatalf("exporting to %v wrote %v rules, expected %v", format, written, v.written)
+		}
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")[1:]
+		if strings.Join(lines, "\n") != strings.Join(v.expected, "\n") {
+			t.Fatalf("exported to %v as\n%v\nexpected\n%v", format, strings.Join(lines, "\n"), strings.Join(v.expected, "\n"))
+		}
+
+		if len(warnings) != v.warnings {
+			t.Fatalf("exporting to %v gave warnings %v, expected %v", format, warnings, v.warnings)
+		}
+
+		// dnsmasq skips the rule for being exact, not for its sink mode
+		sinkWarned := format == FormatDnsmasq
+
+		for _, w := range warnings {
+			if w.Item.String() == "e;sink=refused;refused.example.com" && strings.Contains(w.Reason, "sink response") {
+				sinkWarned = true
+			}
+		}
+
+		if !sinkWarned {
+			t.Fatalf("exporting to %v gave no warning for a sink mode it cannot write: %v", format, warnings)
+		}
+	}
+
+	if _, _, err := Export(set, &bytes.Buffer{}, FormatDNSCrypt); err == nil {
+		t.Fatalf("no error exporting to a format without an exporter")
+	}
+}
+
+func TestExportAdblockRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	set := exportTestSet(t)
+
+	if _, _, err := Export(set, &out, FormatAdblock); err != nil {
+		t.Fatalf("could not export: %v", err)
+	}
+
+	parsed := make([]IRule, 0)
+
+	for _, v := range strings.Split(out.String(), "\n") {
+		rules, _, err := parseAdblockLine(v)
+		if err != nil {
+			t.Fatalf("exported line '%v' does not parse: %v", v, err)
+		}
+
+		parsed = append(parsed, rules...)
+	}
+
+	imported := NewRuleSet(parsed)
+
+	for _, domain := range []string{"exact.example.com", "a.example.org", "x.tracker.com", "ad1.example.com", "safe.example.org", "other.com", "v6.example.com"} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if imported.TestQuery(domain, qtype) != set.TestQuery(domain, qtype) {
+				t.Fatalf("%v (%v) was matched differently after exporting", domain, dns.Type(qtype))
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	fixtureArrow   string = "->"
+	fixtureSink    string = "sink"
+	fixtureForward string = "forward"
+)
+
+// Fixture is an expected outcome for a query: whether a RuleSet should
+// sinkhole it or forward it. Fixture files hold one per line, with the query
+// type after the domain if it is not A:
+//
+//	# critical domains
+//	ads.example.com -> sink
+//	www.example.com -> forward
+//	v6.example.com AAAA -> sink
+type Fixture struct {
+	Domain string
+	Type   uint16 // The query type
+	Sink   bool
+	Path   string // Path to the fixture file
+	Line   int    // Line number in the fixture file, from 1
+}
+
+func (f Fixture) String() string {
+	outcome := fixtureForward
+	if f.Sink {
+		outcome = fixtureSink
+	}
+
+	query := f.Domain
+	if f.Type != dns.TypeA {
+		query += " " + dns.Type(f.Type).String()
+	}
+
+	return fmt.Sprintf("%v %v %v", query, fixtureArrow, outcome)
+}
+
+// parseFixture parses a line of a fixture file, returning false for blank lines
+// and comments.
+func parseFixture(text string) (Fixture, bool, error) {
+	text = strings.TrimSpace(text)
+
+	if text == "" || text[0] == '#' {
+		return Fixture{}, false, nil
+	}
+
+	split := strings.SplitN(text, fixtureArrow, 2)
+	if len(split) != 2 {
+		return Fixture{}, false, fmt.Errorf("expected `domain %v sink|forward`", fixtureArrow)
+	}
+
+	query := strings.Fields(split[0])
+	if len(query) < 1 || len(query) > 2 {
+		return Fixture{}, false, fmt.Errorf("'%v' is not a domain and optional query type", strings.TrimSpace(split[0]))
+	}
+
+	f := Fixture{Domain: strings.TrimSuffix(strings.ToLower(query[0]), "."), Type: dns.TypeA}
+
+	if len(query) == 2 {
+		qtype, err := ParseQueryType(query[1])
+
+		if err != nil {
+			return Fixture{}, false, err
+		}
+
+		f.Type = qtype
+	}
+
+	switch outcome := strings.ToLower(strings.TrimSpace(split[1])); outcome {
+	case fixtureSink:
+		f.Sink = true
+	case fixtureForward:
+	default:
+		return Fixture{}, false, fmt.Errorf("unknown outcome `%v`, expected %v or %v", outcome, fixtureSink, fixtureForward)
+	}
+
+	return f, true, nil
+}
+
+// LoadFixtures reads the fixtures in a fixture file.
+func LoadFixtures(filepath string) ([]Fixture, error) {
+	f, err := os.Open(filepath)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not open fixture file '%v'", filepath)
+	}
+	defer f.Close()
+
+	fixtures := make([]Fixture, 0)
+	scanner := bufio.NewScanner(f)
+
+	for line := 1; scanner.Scan(); line++ {
+		fixture, ok, err := parseFixture(scanner.Text())
+
+		if err != nil {
+			return nil, fmt.Errorf("%v: fixture file %v line %v", err, filepath, line)
+		}
+
+		if ok {
+			fixture.Path, fixture.Line = filepath, line
+			fixtures = append(fixtures, fixture)
+		}
+	}
+
+	return fixtures, scanner.Err()
+}
+
+// FixtureResult is the outcome of testing a Fixture against a RuleSet.
+type FixtureResult struct {
+	Fixture Fixture
+	Passed  bool
+	Verdict Verdict // Why the RuleSet gave the outcome it did
+}
+
+func (r FixtureResult) String() string {
+	status := "ok"
+	if !r.Passed {
+		status = "FAIL"
+	}
+
+	return fmt.Sprintf("%v:%v: %v: %v: %v", r.Fixture.Path, r.Fixture.Line, status, r.Fixture, r.Verdict)
+}
+
+// TestFixtures tests every fixture with TestQuery, explaining the verdict for
+// each.
+func (s *RuleSet) TestFixtures(fixtures []Fixture) []FixtureResult {
+	results := make([]FixtureResult, 0, len(fixtures))
+
+	for _, v := range fixtures {
+		results = append(results, FixtureResult{v, s.TestQuery(v.Domain, v.Type) == v.Sink, s.ExplainQuery(v.Domain, v.Type)})
+	}
+
+	return results
+}
@@ -0,0 +1,76 @@
+package rules
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoadFixtures(t *testing.T) {
+	filepath := path.Join(t.TempDir(), "fixtures")
+	data := "# critical domains\n\nAds.Example.com. -> sink\nwww.example.com->forward\nsafe.ads.example.com -> FORWARD\nv6.example.com aaaa -> sink\n"
+
+	if err := ioutil.WriteFile(filepath, []byte(data), 0644); err != nil {
+		t.Fatalf("could not write fixture file: %v", err)
+	}
+
+	fixtures, err := LoadFixtures(filepath)
+	if err != nil {
+		t.Fatalf("could not load fixtures: %v", err)
+	}
+
+	expected := []Fixture{
+		{"ads.example.com", dns.TypeA, true, filepath, 3},
+		{"www.example.com", dns.TypeA, false, filepath, 4},
+		{"safe.ads.example.com", dns.TypeA, false, filepath, 5},
+		{"v6.example.com", dns.TypeAAAA, true, filepath, 6},
+	}
+
+	if len(fixtures) != len(expected) {
+		t.Fatalf("loaded fixtures %v, expected %v", fixtures, expected)
+	}
+
+	for k, v := range expected {
+		if fixtures[k] != v {
+			t.Fatalf("loaded fixture %v, expected %v", fixtures[k], v)
+		}
+	}
+
+	for _, line := range []string{"example.com", "example.com -> block", " -> sink", "a b c.com -> sink", "example.com bogus -> sink"} {
+		if _, _, err := parseFixture(line); err == nil {
+			t.Fatalf("no error for invalid fixture '%v'", line)
+		}
+	}
+}
+
+func TestTestFixtures(t *testing.T) {
+	ads, _ := RuleFromString("d;;ads.example.com")
+	safe, _ := RuleFromString("e;w;safe.ads.example.com")
+	v6, _ := RuleFromString("e;qtype=AAAA;v6.example.com")
+	set := newRuleSet([]IRule{ads, safe, v6}, []RuleSource{{"block", 1}, {"allow", 1}, {"block", 2}})
+
+	results := set.TestFixtures([]Fixture{
+		{Domain: "x.ads.example.com", Type: dns.TypeA, Sink: true},
+		{Domain: "safe.ads.example.com", Type: dns.TypeA, Sink: false},
+		{Domain: "ads.example.com", Type: dns.TypeA, Sink: false},
+		{Domain: "tracker.example.com", Type: dns.TypeA, Sink: true},
+		{Domain: "v6.example.com", Type: dns.TypeAAAA, Sink: true},
+		{Domain: "v6.example.com", Type: dns.TypeA, Sink: false},
+	})
+
+	for k, passed := range []bool{true, true, false, false, true, true} {
+		if results[k].Passed != passed {
+			t.Fatalf("fixture %v passed: %v, expected %v", results[k].Fixture, results[k].Passed, passed)
+		}
+	}
+
+	if results[2].Verdict.Rule != ads || results[2].Verdict.Source != (RuleSource{"block", 1}) {
+		t.Fatalf("failure was not explained by the rule that caused it: %v", results[2].Verdict)
+	}
+
+	if results[3].Verdict.Rule != nil {
+		t.Fatalf("unexpected rule for an unmatched domain: %v", results[3].Verdict)
+	}
+}
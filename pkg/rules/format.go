@@ -0,0 +1,184 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Format is the syntax a rule file is written in.
+type Format string
+
+const (
+	FormatDNSFSD   Format = "dnsfsd"   // `t;w;rule` lines
+	FormatAdblock  Format = "adblock"  // Adblock Plus style DNS filters, e.g. `||example.com^`
+	FormatHosts    Format = "hosts"    // hosts file lines, e.g. `0.0.0.0 example.com`
+	FormatDNSCrypt Format = "dnscrypt" // dnscrypt-proxy blocked names, e.g. `*.example.com`
+	FormatDnsmasq  Format = "dnsmasq"  // dnsmasq options, e.g. `address=/example.com/0.0.0.0`
+)
+
+// lineParser parses a single line of a rule file into rules and local records.
+// Lines that hold neither, such as comments, give empty slices; lines that
+// cannot be expressed as rules give an error saying why.
+type lineParser func(text string) ([]IRule, []Record, error)
+
+var (
+	parsers = map[Format]lineParser{
+		FormatDNSFSD:   parseDNSFSDLine,
+		FormatAdblock:  parseAdblockLine,
+		FormatHosts:    parseHostsLine,
+		FormatDNSCrypt: parseDNSCryptLine,
+		FormatDnsmasq:  parseDnsmasqLine,
+	}
+
+	formatExtensions = map[string]Format{
+		".abp":      FormatAdblock,
+		".adblock":  FormatAdblock,
+		".hosts":    FormatHosts,
+		".dnscrypt": FormatDNSCrypt,
+		".dnsmasq":  FormatDnsmasq,
+	}
+
+	formatNames = map[string]Format{
+		"hosts": FormatHosts,
+	}
+
+	// e.g. `# format: adblock` or `! format: adblock`
+	formatDirective = regexp.MustCompile(`^[#!]\s*format:\s*(\S+)\s*$`)
+)
+
+// ParseFormat returns the Format named by text, or an error if there is no such
+// format.
+func ParseFormat(text string) (Format, error) {
+	format := Format(strings.ToLower(strings.TrimSpace(text)))
+
+	if _, ok := parsers[format]; !ok {
+		return "", fmt.Errorf("unknown rule file format `%v`", text)
+	}
+
+	return format, nil
+}
+
+// DetectFormat works out the format of a rule file. A header directive in the
+// comments at the top of the file (`# format: <name>`, or an Adblock
+// `[Adblock Plus 2.0]` header) is used first, then the file's extension or, for
+// files named `hosts`, its name. Files with none of these are in the dnsfsd
+// format.
+func DetectFormat(filepath string, lines []string) Format {
+	for _, v := range lines {
+		v = strings.TrimSpace(v)
+
+		if v == "" {
+			continue
+		}
+
+		if strings.HasPrefix(v, "[Adblock") {
+			return FormatAdblock
+		}
+
+		if match := formatDirective.FindStringSubmatch(v); match != nil {
+			if format, err := ParseFormat(match[1]); err == nil {
+				return format
+			}
+		}
+
+		if v[0] != '#' && v[0] != '!' {
+			break // past the header
+		}
+	}
+
+	if format, ok := formatExtensions[strings.ToLower(path.Ext(filepath))]; ok {
+		return format
+	}
+
+	if format, ok := formatNames[strings.ToLower(path.Base(filepath))]; ok {
+		return format
+	}
+
+	return FormatDNSFSD
+}
+
+// LoadMode is how a RuleFile treats lines that cannot be parsed.
+type LoadMode int
+
+const (
+	// LoadLenient skips lines that cannot be parsed, reporting them in
+	// Diagnostics, so one bad line does not stop a whole file loading.
+	LoadLenient LoadMode = iota
+	// LoadStrict fails on the first line that cannot be parsed, returning its
+	// Diagnostic as the error.
+	LoadStrict
+)
+
+// Diagnostic reports a line of a rule file that was skipped as it could not be
+// expressed as a rule.
+type Diagnostic struct {
+	Path   string // Path to the rule file
+	Line   int    // Line number, from 1
+	Column int    // Column of the problem in the line, from 1, or 0 if not known
+	Text   string // The line itself
+	Reason string // Why the line was skipped
+}
+
+func (d Diagnostic) String() string {
+	if d.Column > 0 {
+		return fmt.Sprintf("%v:%v:%v: %v: '%v'", d.Path, d.Line, d.Column, d.Reason, d.Text)
+	}
+
+	return fmt.Sprintf("%v:%v: %v: '%v'", d.Path, d.Line, d.Reason, d.Text)
+}
+
+// Error allows a Diagnostic to be returned as the error of a strict load.
+func (d Diagnostic) Error() string {
+	return d.String()
+}
+
+// lineError is an error parsing a line, with the part of the line at fault.
+type lineError struct {
+	part string
+	err  error
+}
+
+func (e lineError) Error() string {
+	return e.err.Error()
+}
+
+func (e lineError) Unwrap() error {
+	return e.err
+}
+
+// errorAt marks err as being caused by part, a substring of the line being
+// parsed, so diagnostics can give its column.
+func errorAt(part string, err error) error {
+	return lineError{part, err}
+}
+
+// newDiagnostic creates the Diagnostic for an error parsing a line, finding the
+// column of the part of the line at fault, if it is known.
+func newDiagnostic(path string, line int, text string, err error) Diagnostic {
+	d := Diagnostic{Path: path, Line: line, Text: text, Reason: err.Error()}
+	var e lineError
+
+	if errors.As(err, &e) && strings.TrimSpace(e.part) != "" {
+		// parsers may have changed the case of the part
+		d.Column = strings.Index(strings.ToLower(text), strings.ToLower(strings.TrimSpace(e.part))) + 1
+	}
+
+	return d
+}
+
+func parseDNSFSDLine(text string) ([]IRule, []Record, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil, nil
+	}
+
+	rule, err := RuleFromString(text)
+
+	if err != nil || rule == nil {
+		return nil, nil, err
+	}
+
+	return []IRule{rule}, nil, nil
+}
@@ -0,0 +1,69 @@
+package rules
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestLoadModes(t *testing.T) {
+	filepath := path.Join(t.TempDir(), "rules")
+	data := "e;;ads.example.com\nr;;^ad[0-9\nd;;tracker.example.com\nx;;unknown.example.com\n"
+
+	if err := ioutil.WriteFile(filepath, []byte(data), 0644); err != nil {
+		t.Fatalf("could not write rule file: %v", err)
+	}
+
+	file := RuleFile{Path: filepath}
+	if err := file.Load(); err != nil {
+		t.Fatalf("lenient load failed: %v", err)
+	}
+
+	if len(*file.Rules) != 2 || len(*file.Diagnostics) != 2 {
+		t.Fatalf("lenient load gave %v rules and diagnostics %v, expected 2 and 2", len(*file.Rules), *file.Diagnostics)
+	}
+
+	if d := (*file.Diagnostics)[0]; d.Line != 2 || d.Column != 4 {
+		t.Fatalf("bad regular expression reported at %v:%v, expected 2:4", d.Line, d.Column)
+	}
+
+	file = RuleFile{Path: filepath, Mode: LoadStrict}
+	err := file.Load()
+
+	var d Diagnostic
+	if !errors.As(err, &d) || d.Line != 2 || d.Path != filepath {
+		t.Fatalf("strict load did not fail on the first bad line: %v", err)
+	}
+
+	if file.Loaded {
+		t.Fatalf("strict load marked the file as loaded")
+	}
+}
+
+func TestDiagnosticColumns(t *testing.T) {
+	cases := []struct {
+		format Format
+		line   string
+		column int
+	}{
+		{FormatDNSFSD, "  e;sink=nope;example.com", 5},
+		{FormatDNSFSD, "q;;example.com", 1},
+		{FormatAdblock, "example.com##.banner", 12},
+		{FormatAdblock, "||Example.com^$script", 15},
+		{FormatHosts, "\t0.0.0.300 example.com", 2},
+		{FormatDNSCrypt, "Example.com @work", 13},
+		{FormatDnsmasq, "address=/example.com/10.0.0.1", 22},
+	}
+
+	for _, v := range cases {
+		_, _, err := parsers[v.format](v.line)
+		if err == nil {
+			t.Fatalf("no error for %v line '%v'", v.format, v.line)
+		}
+
+		if d := newDiagnostic("test", 1, v.line, err); d.Column != v.column {
+			t.Fatalf("%v line '%v' reported at column %v, expected %v (%v)", v.format, v.line, d.Column, v.column, d)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostsStandardNames are the names every hosts file maps to itself, which are
+// neither blocked nor answered.
+var hostsStandardNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// Record is a local answer for a domain, given by a hosts file line pointing
+// the domain at an address other than a sink address.
+type Record struct {
+	Domain string
+	IP     net.IP
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%v %v", r.IP, r.Domain)
+}
+
+// isSinkAddress returns whether a hosts file address is one used to block a
+// domain, e.g. 0.0.0.0, 127.0.0.1 or ::.
+func isSinkAddress(ip net.IP) bool {
+	return ip.IsUnspecified() || ip.IsLoopback()
+}
+
+// parseHostsLine parses a line of a hosts file:
+//
+//	0.0.0.0 ads.example.com       blocked (e;;ads.example.com)
+//	127.0.0.1 a.example b.example  both blocked
+//	192.168.1.10 nas.home          answered locally with 192.168.1.10
+//	# comment
+//
+// Domains pointed at a sink address (unspecified or loopback) become block
+// rules and domains pointed at any other address become local records.
+func parseHostsLine(text string) ([]IRule, []Record, error) {
+	if i := strings.IndexByte(text, '#'); i >= 0 {
+		text = text[:i]
+	}
+
+	fields := strings.Fields(text)
+
+	if len(fields) == 0 {
+		return nil, nil, nil
+	}
+
+	ip := net.ParseIP(fields[0])
+
+	if ip == nil {
+		return nil, nil, errorAt(fields[0], fmt.Errorf("'%v' is not a valid ip address", fields[0]))
+	}
+
+	if len(fields) == 1 {
+		return nil, nil, errorAt(fields[0], fmt.Errorf("no host names for address %v", fields[0]))
+	}
+
+	sink := isSinkAddress(ip)
+	rules := make([]IRule, 0)
+	records := make([]Record, 0)
+
+	for _, v := range fields[1:] {
+		host := strings.TrimSuffix(strings.ToLower(v), ".")
+
+		if _, ok := hostsStandardNames[host]; ok || host == "" {
+			continue
+		}
+
+		if sink {
+			rules = append(rules, equalsRule{host, false})
+		} else {
+			records = append(records, Record{host, ip})
+		}
+	}
+
+	return rules, records, nil
+}
@@ -0,0 +1,104 @@
+package rules
+
+import (
+	"io/ioutil"
+	"net"
+	"path"
+	"testing"
+)
+
+func TestHostsLines(t *testing.T) {
+	cases := map[string][]string{
+		"0.0.0.0 ads.example.com":                   {"e;;ads.example.com"},
+		"127.0.0.1\tA.example.com b.example.com. ":  {"e;;a.example.com", "e;;b.example.com"},
+		":: tracker.example.com # trailing comment": {"e;;tracker.example.com"},
+		"127.0.0.1 localhost":                       {},
+		"::1 localhost ip6-localhost ip6-loopback":  {},
+		"0.0.0.0 0.0.0.0":                           {},
+		"# 0.0.0.0 commented.example.com":           {},
+		"":                                          {},
+	}
+
+	for line, expected := range cases {
+		parsed, records, err := parseHostsLine(line)
+		if err != nil {
+			t.Fatalf("line '%v' gave error: %v", line, err)
+		}
+
+		if len(records) != 0 || len(parsed) != len(expected) {
+			t.Fatalf("line '%v' was parsed as %v %v, expected %v", line, parsed, records, expected)
+		}
+
+		for k, v := range parsed {
+			if v.String() != expected[k] {
+				t.Fatalf("line '%v' was parsed as %v, expected %v", line, parsed, expected)
+			}
+		}
+	}
+
+	parsed, records, err := parseHostsLine("192.168.1.10 nas.home NAS.lan")
+	if err != nil || len(parsed) != 0 || len(records) != 2 {
+		t.Fatalf("unexpected result for a local record line: %v %v %v", parsed, records, err)
+	}
+
+	if records[1].Domain != "nas.lan" || !records[1].IP.Equal(net.ParseIP("192.168.1.10")) {
+		t.Fatalf("unexpected record %v", records[1])
+	}
+
+	for _, line := range []string{"example.com", "300.0.0.1 example.com", "0.0.0.0"} {
+		if _, _, err := parseHostsLine(line); err == nil {
+			t.Fatalf("no error for invalid line '%v'", line)
+		}
+	}
+}
+
+func TestDetectHostsFormat(t *testing.T) {
+	cases := []struct {
+		path     string
+		lines    []string
+		expected Format
+	}{
+		{"/etc/dnsfsd/rules/hosts", []string{"0.0.0.0 example.com"}, FormatHosts},
+		{"blocklist.hosts", []string{"0.0.0.0 example.com"}, FormatHosts},
+		{"list.txt", []string{"# format: hosts", "0.0.0.0 example.com"}, FormatHosts},
+		{"list.txt", []string{"0.0.0.0 example.com"}, FormatDNSFSD},
+	}
+
+	for _, v := range cases {
+		if format := DetectFormat(v.path, v.lines); format != v.expected {
+			t.Fatalf("'%v' %v was detected as %v, expected %v", v.path, v.lines, format, v.expected)
+		}
+	}
+}
+
+func TestLoadHosts(t *testing.T) {
+	filepath := path.Join(t.TempDir(), "list.hosts")
+	data := "# blocklist\n127.0.0.1 localhost\n0.0.0.0 ads.example.com\nnot-an-ip bad.example.com\n10.0.0.2 nas.home\nfd00::2 nas.home\n"
+
+	if err := ioutil.WriteFile(filepath, []byte(data), 0644); err != nil {
+		t.Fatalf("could not write rule file: %v", err)
+	}
+
+	file := RuleFile{Path: filepath}
+	if err := file.Load(); err != nil {
+		t.Fatalf("could not load hosts file: %v", err)
+	}
+
+	if file.Format != FormatHosts || len(*file.Rules) != 1 || len(*file.Records) != 2 {
+		t.Fatalf("file loaded as %v with %v rules and %v records, expected hosts with 1 and 2",
+			file.Format, len(*file.Rules), len(*file.Records))
+	}
+
+	if diagnostics := *file.Diagnostics; len(diagnostics) != 1 || diagnostics[0].Line != 4 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+
+	set := CollectAllRules(&[]RuleFile{file})
+	if !set.Test("ads.example.com") || set.Test("nas.home") {
+		t.Fatalf("hosts rules did not match as expected")
+	}
+
+	if ips := set.Lookup("nas.home"); len(ips) != 2 || set.Lookup("ads.example.com") != nil {
+		t.Fatalf("unexpected local records %v", ips)
+	}
+}
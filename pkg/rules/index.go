@@ -0,0 +1,105 @@
+package rules
+
+import "strings"
+
+// ruleIndex holds either the whitelist or the blacklist rules of a RuleSet,
+// indexed by opcode so that matching a domain does not mean testing every rule
+// in turn: equals and suffix rules are kept in hash sets and contains rules in
+// an Aho-Corasick automaton. Only the remaining rules, regular expressions, are
+// tested one by one.
+type ruleIndex struct {
+	equals   map[string][]IRule
+	suffixes map[string][]IRule
+	contains *ahoCorasick
+	patterns [][]IRule // contains rules by automaton pattern index
+	others   []IRule
+}
+
+// baseRule returns the rule a rule with options wraps, or the rule itself.
+func baseRule(rule IRule) IRule {
+	if r, ok := rule.(optionsRule); ok {
+		return r.IRule
+	}
+
+	return rule
+}
+
+func newRuleIndex(rules []IRule) *ruleIndex {
+	i := &ruleIndex{equals: make(map[string][]IRule), suffixes: make(map[string][]IRule)}
+	patterns := make([]string, 0)
+	patternIndex := make(map[string]int)
+
+	for _, v := range rules {
+		switch r := baseRule(v).(type) {
+		case equalsRule:
+			i.equals[r.str] = append(i.equals[r.str], v)
+		case suffixRule:
+			i.suffixes[r.domain] = append(i.suffixes[r.domain], v)
+		case containsRule:
+			k, ok := patternIndex[r.substring]
+
+			if !ok {
+				k = len(patterns)
+				patternIndex[r.substring] = k
+				patterns = append(patterns, r.substring)
+				i.patterns = append(i.patterns, nil)
+			}
+
+			i.patterns[k] = append(i.patterns[k], v)
+		default:
+			i.others = append(i.others, v)
+		}
+	}
+
+	i.contains = newAhoCorasick(patterns)
+	return i
+}
+
+// firstOfType returns the first rule in rules that applies to qtype, or nil.
+func firstOfType(rules []IRule, qtype uint16) IRule {
+	for _, v := range rules {
+		if v.MatchType(qtype) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// match returns a rule in the index that matches domain and applies to qtype,
+// or nil. Rules that have to be tested one by one are split between workers
+// goroutines, as with RuleSet.SetParallel.
+func (i *ruleIndex) match(domain string, qtype uint16, workers int) IRule {
+	if r := firstOfType(i.equals[domain], qtype); r != nil {
+		return r
+	}
+
+	if len(i.suffixes) > 0 {
+		// the domain itself, then every parent domain
+		for suffix := domain; ; {
+			if r := firstOfType(i.suffixes[suffix], qtype); r != nil {
+				return r
+			}
+
+			dot := strings.IndexByte(suffix, '.')
+			if dot < 0 {
+				break
+			}
+
+			suffix = suffix[dot+1:]
+		}
+	}
+
+	var match IRule
+
+	i.contains.match(domain, func(pattern int) bool {
+		match = firstOfType(i.patterns[pattern], qtype)
+		return match != nil
+	})
+
+	if match != nil {
+		return match
+	}
+
+	return matchRules(i.others, domain, qtype, workers)
+}
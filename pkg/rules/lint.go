@@ -0,0 +1,275 @@
+package rules
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// minContainsLength is the shortest contains rule that does not match a
+	// large share of all domains.
+	minContainsLength int = 4
+	// maxRegexpInstructions is the largest compiled regular expression that is
+	// still quick to match against every query.
+	maxRegexpInstructions int = 1000
+)
+
+// LintSeverity is how serious a LintIssue is.
+type LintSeverity string
+
+const (
+	LintError   LintSeverity = "error"   // the rule cannot work as intended
+	LintWarning LintSeverity = "warning" // the rule is likely a mistake
+	LintInfo    LintSeverity = "info"    // the rule may be worth a second look
+)
+
+// LintIssue is a problem found with a rule, or a line, by Lint.
+type LintIssue struct {
+	Check    string       `json:"check"`
+	Severity LintSeverity `json:"severity"`
+	Path     string       `json:"path"`
+	Line     int          `json:"line"`
+	Column   int          `json:"column,omitempty"`
+	Rule     string       `json:"rule,omitempty"`
+	Message  string       `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	position := fmt.Sprintf("%v:%v", i.Path, i.Line)
+	if i.Column > 0 {
+		position += fmt.Sprintf(":%v", i.Column)
+	}
+
+	if i.Rule != "" {
+		return fmt.Sprintf("%v: %v: %v: '%v' (%v)", position, i.Severity, i.Message, i.Rule, i.Check)
+	}
+
+	return fmt.Sprintf("%v: %v: %v (%v)", position, i.Severity, i.Message, i.Check)
+}
+
+// lintedRule is a rule and where it was loaded from.
+type lintedRule struct {
+	rule   IRule
+	source RuleSource
+}
+
+// Lint checks loaded rule files for mistakes that loading them does not catch:
+// lines that could not be parsed, duplicate rules, whitelist rules that no
+// blacklist rule could ever be overridden by, unanchored or slow regular
+// expressions, contains rules short enough to match a large share of all
+// domains, and rules with whitespace or upper case letters, which can never
+// match the lower case domains they are tested against. Issues are sorted by
+// file and line.
+func Lint(files *[]RuleFile) []LintIssue {
+	issues := make([]LintIssue, 0)
+	rules := make([]lintedRule, 0)
+
+	for _, v := range *files {
+		if !v.Loaded {
+			continue
+		}
+
+		for _, d := range *v.Diagnostics {
+			issues = append(issues, LintIssue{"parse", LintError, d.Path, d.Line, d.Column, "", d.Reason})
+		}
+
+		for k, rule := range *v.Rules {
+			source := RuleSource{Path: v.Path}
+			if v.Lines != nil && k < len(*v.Lines) {
+				source.Line = (*v.Lines)[k]
+			}
+
+			rules = append(rules, lintedRule{rule, source})
+		}
+	}
+
+	issue := func(r lintedRule, check string, severity LintSeverity, message string, args ...interface{}) {
+		issues = append(issues, LintIssue{check, severity, r.source.Path, r.source.Line, 0, r.rule.String(), fmt.Sprintf(message, args...)})
+	}
+
+	seen := make(map[string]RuleSource, len(rules))
+
+	for _, r := range rules {
+		text := r.rule.String()
+
+		if first, ok := seen[text]; ok {
+			issue(r, "duplicate", LintWarning, "duplicate of the rule at %v", first)
+		} else {
+			seen[text] = r.source
+		}
+
+		lintText(r, issue)
+
+		if expression, ok := baseRule(r.rule).(regexpRule); ok {
+			lintRegexp(r, expression.expression.String(), issue)
+		}
+	}
+
+	for _, r := range unreachableWhitelists(rules) {
+		issue(r, "unreachable-whitelist", LintWarning, "no blacklist rule matches a domain this whitelist rule matches")
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Path != issues[j].Path {
+			return issues[i].Path < issues[j].Path
+		}
+
+		return issues[i].Line < issues[j].Line
+	})
+
+	return issues
+}
+
+type lintIssueFunc func(r lintedRule, check string, severity LintSeverity, message string, args ...interface{})
+
+// lintText checks the text of equals, suffix and contains rules.
+func lintText(r lintedRule, issue lintIssueFunc) {
+	var text string
+
+	switch v := baseRule(r.rule).(type) {
+	case equalsRule:
+		text = v.str
+	case suffixRule:
+		text = v.domain
+	case containsRule:
+		text = v.substring
+
+		if len(strings.TrimSpace(text)) < minContainsLength {
+			issue(r, "short-contains", LintWarning, "contains rules shorter than %v characters match a large share of all domains", minContainsLength)
+		}
+	default:
+		return
+	}
+
+	if strings.IndexFunc(text, unicode.IsSpace) >= 0 {
+		issue(r, "whitespace", LintError, "whitespace in the rule can never match a domain")
+	}
+
+	if strings.ToLower(text) != text {
+		issue(r, "case", LintError, "domains are matched in lower case, so upper case letters can never match")
+	}
+}
+
+// lintRegexp checks a regular expression for missing anchors, literals that
+// can never match a lower case domain, and patterns that are slow to match.
+func lintRegexp(r lintedRule, expression string, issue lintIssueFunc) {
+	re, err := syntax.Parse(expression, syntax.Perl)
+	if err != nil {
+		return // already reported when loading
+	}
+
+	var anchored, upper, space, nested bool
+
+	var walk func(re *syntax.Regexp, repeated bool)
+	walk = func(re *syntax.Regexp, repeated bool) {
+		switch re.Op {
+		case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+			anchored = true
+		case syntax.OpLiteral:
+			for _, c := range re.Rune {
+				upper = upper || (unicode.IsUpper(c) && re.Flags&syntax.FoldCase == 0)
+				space = space || unicode.IsSpace(c)
+			}
+		case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat:
+			nested = nested || repeated
+			repeated = true
+		}
+
+		for _, v := range re.Sub {
+			walk(v, repeated)
+		}
+	}
+
+	walk(re, false)
+
+	if !anchored {
+		issue(r, "regex-unanchored", LintInfo, "regular expression has no ^ or $ anchor, so it matches anywhere in a domain")
+	}
+
+	if upper {
+		issue(r, "case", LintError, "domains are matched in lower case, so upper case letters can never match")
+	}
+
+	if space {
+		issue(r, "whitespace", LintError, "whitespace in the rule can never match a domain")
+	}
+
+	if nested {
+		issue(r, "regex-slow", LintWarning, "nested repetition is catastrophically slow in backtracking engines, e.g. if the rule is exported")
+	}
+
+	if prog, err := syntax.Compile(re.Simplify()); err == nil && len(prog.Inst) > maxRegexpInstructions {
+		issue(r, "regex-slow", LintWarning, "regular expression compiles to %v instructions, which is slow to match against every query", len(prog.Inst))
+	}
+}
+
+// unreachableWhitelists returns the whitelist rules that no blacklist rule
+// could match a domain of. Only rules that are certainly unreachable are
+// returned: a whitelist rule that might match the same domains as a contains
+// or regular expression blacklist rule is assumed to be reachable, as is a
+// contains or regular expression whitelist rule if there are suffix blacklist
+// rules, which block subdomains no list of domains could cover. Query types are
+// ignored, which can only make a rule seem reachable.
+func unreachableWhitelists(rules []lintedRule) []lintedRule {
+	blacklist := make([]IRule, 0)
+	domains := make([]string, 0) // of equals and suffix blacklist rules
+	patterns := false
+	suffixes := false
+
+	for _, r := range rules {
+		if r.rule.Whitelist() {
+			continue
+		}
+
+		blacklist = append(blacklist, r.rule)
+
+		switch v := baseRule(r.rule).(type) {
+		case equalsRule:
+			domains = append(domains, v.str)
+		case suffixRule:
+			domains = append(domains, v.domain)
+			suffixes = true
+		default:
+			patterns = true
+		}
+	}
+
+	index := newRuleIndex(blacklist)
+	unreachable := make([]lintedRule, 0)
+
+	for _, r := range rules {
+		if !r.rule.Whitelist() {
+			continue
+		}
+
+		var reachable bool
+
+		switch v := baseRule(r.rule).(type) {
+		case equalsRule:
+			reachable = index.match(v.str, dns.TypeNone, 1) != nil
+		case suffixRule:
+			reachable = patterns || index.match(v.domain, dns.TypeNone, 1) != nil
+
+			for _, d := range domains {
+				reachable = reachable || strings.HasSuffix(d, "."+v.domain)
+			}
+		default:
+			reachable = patterns || suffixes
+
+			for _, d := range domains {
+				reachable = reachable || r.rule.Match(d)
+			}
+		}
+
+		if !reachable {
+			unreachable = append(unreachable, r)
+		}
+	}
+
+	return unreachable
+}
@@ -0,0 +1,103 @@
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"block": "d;;example.com\nc;;ad\nr;;^(a+)+$\ne;;Upper.example.com\nr;;tracker\nr;;^ADS\\.\n" +
+			"r;;^[a-z]{600}\\.[a-z]{600}$\ne;;\tads.example.net\nr;;^ok[0-9]+\\.example\\.org$\nq;;bad\n",
+		"allow": "d;;example.com\ne;w;www.example.com\nd;w;unused.example.net\ne;w;nothing.example.org\n",
+	}
+
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("could not write rule file: %v", err)
+		}
+	}
+
+	loaded, err := LoadAllRuleFiles(dir, LoadLenient)
+	if err != nil {
+		t.Fatalf("could not load rule files: %v", err)
+	}
+
+	expected := []struct {
+		file     string
+		line     int
+		check    string
+		severity LintSeverity
+	}{
+		{"block", 1, "duplicate", LintWarning},
+		{"block", 2, "short-contains", LintWarning},
+		{"block", 3, "regex-slow", LintWarning},
+		{"block", 4, "case", LintError},
+		{"block", 5, "regex-unanchored", LintInfo},
+		{"block", 6, "case", LintError},
+		{"block", 7, "regex-slow", LintWarning},
+		{"block", 8, "whitespace", LintError},
+		{"block", 10, "parse", LintError},
+	}
+
+	issues := Lint(loaded)
+	found := make(map[string]bool)
+
+	for _, v := range issues {
+		found[fmt.Sprintf("%v:%v %v %v", path.Base(v.Path), v.Line, v.Check, v.Severity)] = true
+
+		if path.Base(v.Path) == "block" && v.Line == 9 {
+			t.Fatalf("issue for a rule with no problems: %v", v)
+		}
+	}
+
+	for _, v := range expected {
+		if !found[fmt.Sprintf("%v:%v %v %v", v.file, v.line, v.check, v.severity)] {
+			t.Fatalf("no %v %v issue for %v line %v in %v", v.severity, v.check, v.file, v.line, issues)
+		}
+	}
+
+	// www.example.com is overridden by d;;example.com, and unused.example.net
+	// might be by a regular expression, but nothing.example.org never is
+	unreachable := 0
+	for _, v := range issues {
+		if v.Check == "unreachable-whitelist" {
+			unreachable++
+
+			if v.Line != 4 {
+				t.Fatalf("reachable whitelist rule reported: %v", v)
+			}
+		}
+	}
+
+	if unreachable != 1 {
+		t.Fatalf("%v unreachable whitelist rules reported, expected 1: %v", unreachable, issues)
+	}
+}
+
+func TestLintSuffixWhitelists(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := ioutil.WriteFile(path.Join(dir, "rules"), []byte("d;;example.com\nc;w;cdn\nr;w;^cdn\\.\n"), 0644); err != nil {
+		t.Fatalf("could not write rule file: %v", err)
+	}
+
+	loaded, err := LoadAllRuleFiles(dir, LoadLenient)
+	if err != nil {
+		t.Fatalf("could not load rule files: %v", err)
+	}
+
+	// both whitelist rules override d;;example.com for cdn.example.com
+	if verdict := CollectAllRules(loaded).Explain("cdn.example.com"); verdict.Sink || verdict.Overridden == nil {
+		t.Fatalf("cdn.example.com was not whitelisted: %+v", verdict)
+	}
+
+	for _, v := range Lint(loaded) {
+		if v.Check == "unreachable-whitelist" {
+			t.Fatalf("reachable whitelist rule reported: %v", v)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package rules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SinkMode is how a sinkholed query is answered.
+type SinkMode string
+
+const (
+	SinkDefault  SinkMode = ""          // use the server's configured mode
+	SinkNoData   SinkMode = "nodata"    // an empty NOERROR reply
+	SinkNXDomain SinkMode = "nxdomain"  // an NXDOMAIN reply
+	SinkRefused  SinkMode = "refused"   // a REFUSED reply
+	SinkNullIP   SinkMode = "null-ip"   // 0.0.0.0 for A queries, :: for AAAA
+	SinkCustomIP SinkMode = "custom-ip" // the server's configured addresses
+)
+
+// ParseSinkMode returns the SinkMode named by text, or an error if there is no
+// such mode.
+func ParseSinkMode(text string) (SinkMode, error) {
+	switch mode := SinkMode(strings.ToLower(text)); mode {
+	case SinkNoData, SinkNXDomain, SinkRefused, SinkNullIP, SinkCustomIP:
+		return mode, nil
+	default:
+		return SinkDefault, fmt.Errorf("unknown sink mode `%v`", text)
+	}
+}
+
+// QueryTypes is a set of DNS query types, as their names separated by `|` and
+// in the order of their type numbers, e.g. `AAAA|HTTPS`. The empty set is every
+// query type.
+type QueryTypes string
+
+const queryTypeSeparator string = "|"
+
+// ParseQueryType parses the name of a query type, such as `aaaa`. Types without
+// a name can be given as `TYPE65534`.
+func ParseQueryType(text string) (uint16, error) {
+	name := strings.ToUpper(strings.TrimSpace(text))
+	qtype, ok := dns.StringToType[name]
+
+	if !ok && strings.HasPrefix(name, "TYPE") {
+		n, err := strconv.ParseUint(name[len("TYPE"):], 10, 16)
+		qtype, ok = uint16(n), err == nil
+	}
+
+	if !ok || qtype == dns.TypeNone {
+		return 0, fmt.Errorf("unknown query type `%v`", strings.TrimSpace(text))
+	}
+
+	return qtype, nil
+}
+
+// ParseQueryTypes parses query type names separated by `|`, such as
+// `aaaa|https`.
+func ParseQueryTypes(text string) (QueryTypes, error) {
+	types := make([]int, 0)
+	seen := make(map[uint16]bool)
+
+	for _, v := range strings.Split(text, queryTypeSeparator) {
+		qtype, err := ParseQueryType(v)
+
+		if err != nil {
+			return "", err
+		}
+
+		if !seen[qtype] {
+			seen[qtype] = true
+			types = append(types, int(qtype))
+		}
+	}
+
+	sort.Ints(types)
+	names := make([]string, 0, len(types))
+
+	for _, v := range types {
+		names = append(names, dns.Type(v).String())
+	}
+
+	return QueryTypes(strings.Join(names, queryTypeSeparator)), nil
+}
+
+// Contains returns true if qtype is in the set. Every set contains
+// dns.TypeNone, which stands for a query of no particular type.
+func (t QueryTypes) Contains(qtype uint16) bool {
+	if t == "" || qtype == dns.TypeNone {
+		return true
+	}
+
+	name := dns.Type(qtype).String()
+
+	for s := string(t); ; {
+		i := strings.Index(s, queryTypeSeparator)
+		if i < 0 {
+			return s == name
+		}
+
+		if s[:i] == name {
+			return true
+		}
+
+		s = s[i+1:]
+	}
+}
+
+const (
+	optionSeparator string = ","
+	sinkOption      string = "sink"
+	qtypeOption     string = "qtype"
+)
+
+// Options are the optional settings a rule can be given after the whitelist
+// signal in its flag field, as comma separated `key=value` pairs. E.g.
+// `e;sink=nxdomain;example.com`, `c;w,sink=refused;tracker` or
+// `d;qtype=AAAA|HTTPS;example.com`.
+type Options struct {
+	Sink  SinkMode   // overrides the server's sink mode for this rule
+	Types QueryTypes // limits the rule to queries of these types
+}
+
+// parseOptions parses the flag field of a rule. Parts without an `=` are
+// ignored, as the flag field has always allowed any text.
+func parseOptions(flags string) (Options, error) {
+	var options Options
+
+	for _, v := range strings.Split(flags, optionSeparator) {
+		split := strings.SplitN(v, "=", 2)
+
+		if len(split) != 2 {
+			continue
+		}
+
+		switch strings.TrimSpace(split[0]) {
+		case sinkOption:
+			mode, err := ParseSinkMode(strings.TrimSpace(split[1]))
+
+			if err != nil {
+				return options, err
+			}
+
+			options.Sink = mode
+		case qtypeOption:
+			types, err := ParseQueryTypes(split[1])
+
+			if err != nil {
+				return options, err
+			}
+
+			options.Types = types
+		default:
+			return options, fmt.Errorf("unknown rule option `%v`", split[0])
+		}
+	}
+
+	return options, nil
+}
+
+func (o Options) String() string {
+	parts := make([]string, 0, 2)
+
+	if o.Sink != SinkDefault {
+		parts = append(parts, sinkOption+"="+string(o.Sink))
+	}
+
+	if o.Types != "" {
+		parts = append(parts, qtypeOption+"="+string(o.Types))
+	}
+
+	return strings.Join(parts, optionSeparator)
+}
+
+// RuleOptions returns the options a rule was given, which are the zero Options
+// for rules given none.
+func RuleOptions(rule IRule) Options {
+	if r, ok := rule.(optionsRule); ok {
+		return r.options
+	}
+
+	return Options{}
+}
+
+// optionsRule wraps a rule that was given options.
+type optionsRule struct {
+	IRule
+	options Options
+}
+
+func (r optionsRule) MatchType(qtype uint16) bool {
+	return r.options.Types.Contains(qtype)
+}
+
+func (r optionsRule) String() string {
+	split := strings.SplitN(r.IRule.String(), ";", 3)
+	flags := r.options.String()
+
+	if split[1] != "" {
+		flags = split[1] + optionSeparator + flags
+	}
+
+	return split[0] + ";" + flags + ";" + split[2]
+}
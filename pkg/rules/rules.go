@@ -16,6 +16,7 @@ const (
 	regexpRulePrefix   string = "r"
 	containsRulePrefix string = "c"
 	equalsRulePrefix   string = "e"
+	suffixRulePrefix   string = "d"
 	whitelistChar      rune   = 'w'
 )
 
@@ -30,45 +31,79 @@ func RuleFromString(text string) (IRule, error) {
 	split := strings.SplitN(text, ";", 3)
 	var ruleText string
 	var whitelist bool = false
+	var options Options
 
 	if len(split) == 3 {
 		if len(split[1]) > 0 {
 			whitelist = rune(split[1][0]) == whitelistChar
 		}
 
+		var err error
+		if options, err = parseOptions(split[1]); err != nil {
+			return nil, errorAt(split[1], fmt.Errorf("could not parse rule '%v': %v", text, err))
+		}
+
+		if whitelist && options.Sink != SinkDefault {
+			return nil, errorAt(split[1], fmt.Errorf("could not parse rule '%v' as whitelist rules cannot have a sink mode", text))
+		}
+
 		ruleText = split[2]
 	} else if len(split) == 2 {
 		ruleText = split[1]
 	} else {
-		return nil, fmt.Errorf("could not parse rule '%v' as it is in an invalid format", text)
+		return nil, errorAt(text, fmt.Errorf("could not parse rule '%v' as it is in an invalid format", text))
 	}
 
+	var rule IRule
+
 	switch split[0] {
 	case regexpRulePrefix:
 		pattern, err := regexp.Compile(ruleText)
 
 		if err != nil {
-			return nil, fmt.Errorf("could not parse rule as regular expression (opcode `r`) '%v'", text)
+			return nil, errorAt(ruleText, fmt.Errorf("could not parse rule as regular expression (opcode `r`) '%v'", text))
 		}
 
-		return regexpRule{pattern, whitelist}, nil
+		rule = regexpRule{pattern, whitelist}
 	case containsRulePrefix:
-		return containsRule{ruleText, whitelist}, nil
+		rule = containsRule{ruleText, whitelist}
 	case equalsRulePrefix:
-		return equalsRule{ruleText, whitelist}, nil
+		rule = equalsRule{ruleText, whitelist}
+	case suffixRulePrefix:
+		domain := strings.TrimSuffix(strings.TrimPrefix(ruleText, "."), ".")
+
+		if domain == "" {
+			return nil, errorAt(text, fmt.Errorf("could not parse rule '%v' as a domain suffix (opcode `d`) must not be empty", text))
+		}
+
+		rule = suffixRule{domain, whitelist}
 	default:
-		return nil, fmt.Errorf("could not parse rule '%v' as opcode `%v` is unknown", text, split[0])
+		return nil, errorAt(text, fmt.Errorf("could not parse rule '%v' as opcode `%v` is unknown", text, split[0]))
+	}
+
+	if options != (Options{}) {
+		rule = optionsRule{rule, options}
 	}
+
+	return rule, nil
 }
 
 // RuleFile is a representation of a file containing rules.
 type RuleFile struct {
-	Path   string   // Path to the file
-	Loaded bool     // Whether the file has been loadaed yet
-	Rules  *[]IRule // A pointer to a slice of rules that have been loaded
+	Path        string        // Path to the file
+	Loaded      bool          // Whether the file has been loadaed yet
+	Format      Format        // The format the file was loaded as
+	Mode        LoadMode      // How lines that cannot be parsed are treated
+	Rules       *[]IRule      // A pointer to a slice of rules that have been loaded
+	Lines       *[]int        // A pointer to a slice of the line number of each rule
+	Diagnostics *[]Diagnostic // A pointer to a slice of the lines that were skipped
+	Records     *[]Record     // A pointer to a slice of local records, from hosts files
 }
 
-// Load loads a RuleFile and returns any errors.
+// Load loads a RuleFile and returns any errors. Unless Format is already set,
+// the format of the file is found with DetectFormat. Lines that cannot be
+// parsed are skipped and reported in Diagnostics or, if Mode is LoadStrict,
+// the first of them is returned as an error.
 func (p *RuleFile) Load() error {
 	f, err := os.Open(p.Path)
 
@@ -77,19 +112,10 @@ func (p *RuleFile) Load() error {
 	}
 
 	scanner := bufio.NewScanner(f)
-	rules := make([]IRule, 0)
+	text := make([]string, 0)
 
 	for scanner.Scan() {
-		text := scanner.Text()
-		rule, err := RuleFromString(text)
-
-		if err != nil {
-			return fmt.Errorf("%v: rule file %v", err, p.Path)
-		}
-
-		if rule != nil {
-			rules = append(rules, rule)
-		}
+		text = append(text, scanner.Text())
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -100,14 +126,56 @@ func (p *RuleFile) Load() error {
 		return err
 	}
 
+	format := p.Format
+	if format == "" {
+		format = DetectFormat(p.Path, text)
+	}
+
+	parse, ok := parsers[format]
+	if !ok {
+		return fmt.Errorf("unknown rule file format `%v` for rule file %v", format, p.Path)
+	}
+
+	rules := make([]IRule, 0)
+	lines := make([]int, 0)
+	diagnostics := make([]Diagnostic, 0)
+	records := make([]Record, 0)
+
+	for k, v := range text {
+		parsed, parsedRecords, err := parse(v)
+
+		if err != nil {
+			d := newDiagnostic(p.Path, k+1, v, err)
+
+			if p.Mode == LoadStrict {
+				return d
+			}
+
+			diagnostics = append(diagnostics, d)
+			continue
+		}
+
+		for _, rule := range parsed {
+			rules = append(rules, rule)
+			lines = append(lines, k+1)
+		}
+
+		records = append(records, parsedRecords...)
+	}
+
+	p.Format = format
 	p.Rules = &rules
+	p.Lines = &lines
+	p.Diagnostics = &diagnostics
+	p.Records = &records
 	p.Loaded = true
 
 	return nil
 }
 
 // AllRulesFiles returns a pointer to a slice of RuleFiles inside a given
-// directory, and any errors encountered whislst reading the directory.
+// directory, and any errors encountered whislst reading the directory. Hidden
+// files, such as downloads still being written, are left out.
 func AllRulesFiles(directory string) (*[]RuleFile, error) {
 	files, err := ioutil.ReadDir(directory)
 	paths := make([]RuleFile, 0)
@@ -117,8 +185,8 @@ func AllRulesFiles(directory string) (*[]RuleFile, error) {
 	}
 
 	for _, v := range files {
-		if !v.IsDir() {
-			paths = append(paths, RuleFile{path.Join(directory, v.Name()), false, nil})
+		if !v.IsDir() && !strings.HasPrefix(v.Name(), ".") {
+			paths = append(paths, RuleFile{Path: path.Join(directory, v.Name())})
 		}
 	}
 
@@ -127,8 +195,8 @@ func AllRulesFiles(directory string) (*[]RuleFile, error) {
 
 // LoadAllRuleFiles returns a pointer to a slice of *loaded* RuleFiles in a
 // given directory and any errors encountered whilst reading and loading the
-// files.
-func LoadAllRuleFiles(path string) (*[]RuleFile, error) {
+// files. Each file is loaded with the given mode.
+func LoadAllRuleFiles(path string, mode LoadMode) (*[]RuleFile, error) {
 	files, err := AllRulesFiles(path)
 
 	if err != nil {
@@ -138,6 +206,8 @@ func LoadAllRuleFiles(path string) (*[]RuleFile, error) {
 	successes := make([]RuleFile, 0, len(*files))
 
 	for _, v := range *files {
+		v.Mode = mode
+
 		if err := v.Load(); err == nil {
 			successes = append(successes, v)
 		} else {
@@ -148,58 +218,122 @@ func LoadAllRuleFiles(path string) (*[]RuleFile, error) {
 	return &successes, nil
 }
 
-// CollectAllRules creates a RuleSet from a pointer to a slice of RuleFiles. All
-// RuleFiles must already be loaded otherwise they will be skipped.
+// CollectAllRules creates a RuleSet from a pointer to a slice of RuleFiles,
+// along with the local records of any hosts files. All RuleFiles must already
+// be loaded otherwise they will be skipped.
 func CollectAllRules(files *[]RuleFile) *RuleSet {
-	l := make(map[IRule]struct{})
+	l := make([]IRule, 0)
+	sources := make([]RuleSource, 0)
+	records := make([]Record, 0)
 
 	for _, v := range *files {
 		if v.Loaded {
-			for _, rule := range *v.Rules {
-				l[rule] = struct{}{}
+			l = append(l, *v.Rules...)
+
+			if v.Records != nil {
+				records = append(records, *v.Records...)
+			}
+
+			for k := range *v.Rules {
+				source := RuleSource{Path: v.Path}
+
+				if v.Lines != nil && k < len(*v.Lines) {
+					source.Line = (*v.Lines)[k]
+				}
+
+				sources = append(sources, source)
 			}
 		}
 	}
 
-	return &RuleSet{&l}
+	set := newRuleSet(l, sources)
+	set.SetRecords(records)
+
+	return set
 }
 
-// DownloadRuleFile downloads over http from a given URL to /etc/dnsfsd/rules
-// and a given file name. It returns the number of rules in the file and any
-// errors encountered.
-func DownloadRuleFile(url string, filename string) (int, error) {
-	resp, err := http.Get(url)
+// writeRuleFile writes a rule file to a directory without ever leaving a
+// partial, unverified or unparseable file in place of an existing one: it is
+// written to a hidden temporary file first, checked with verify if it is not
+// nil, loaded, and only renamed into place if it loads and holds at least one
+// rule or local record. An empty format means the format is detected as usual.
+func writeRuleFile(directory string, filename string, body io.Reader, format Format, verify func(filepath string) error) (RuleFile, error) {
+	if err := os.MkdirAll(directory, os.FileMode(0755)); err != nil {
+		return RuleFile{}, err
+	}
 
+	// keep the extension, which DetectFormat may need
+	tmp, err := ioutil.TempFile(directory, ".*."+filename)
 	if err != nil {
-		return 0, fmt.Errorf("could not download from url: '%v'", url)
+		return RuleFile{}, fmt.Errorf("could not create temporary file in '%v'", directory)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return 0, fmt.Errorf("HTTP request to '%v' gave a %v status code", url, resp.StatusCode)
+	file := RuleFile{Path: tmp.Name(), Format: format}
+
+	if err = tmp.Chmod(os.FileMode(0644)); err == nil {
+		_, err = io.Copy(tmp, body)
 	}
 
-	const directory string = "/etc/dnsfsd/rules"
-	if err := os.MkdirAll(directory, os.FileMode(0755)); err != nil {
-		return 0, err
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
 	}
 
-	filepath := path.Join(directory, filename)
-	out, err := os.Create(filepath)
+	if err == nil && verify != nil {
+		err = verify(tmp.Name())
+	}
+
+	if err == nil {
+		err = file.Load()
+	}
+
+	if err == nil && len(*file.Rules) == 0 && len(*file.Records) == 0 {
+		err = fmt.Errorf("no rules could be loaded from '%v'", filename)
+	}
+
+	// other formats hold lines meant only for browsers, but a dnsfsd file with
+	// a bad line is most likely truncated or corrupt
+	if err == nil && file.Format == FormatDNSFSD && len(*file.Diagnostics) > 0 {
+		d := (*file.Diagnostics)[0]
+		d.Path = filename
+		err = d
+	}
+
+	if err == nil {
+		file.Path = path.Join(directory, filename)
+		err = os.Rename(tmp.Name(), file.Path)
+	}
 
 	if err != nil {
-		return 0, fmt.Errorf("could not create file '%v'", filepath)
+		_ = os.Remove(tmp.Name())
+		return RuleFile{}, err
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	return file, nil
+}
+
+// DownloadRuleFile downloads over http from a given URL to /etc/dnsfsd/rules
+// and a given file name. The download is checked against verification, and
+// must load cleanly, before it is renamed into place; until then any existing
+// file of that name is left as it is. It returns the number of rules in the
+// file and any errors encountered.
+func DownloadRuleFile(url string, filename string, verification Verification) (int, error) {
+	return downloadRuleFile(http.DefaultClient, url, "/etc/dnsfsd/rules", filename, verification)
+}
+
+func downloadRuleFile(client *http.Client, url string, directory string, filename string, verification Verification) (int, error) {
+	resp, err := client.Get(url)
+
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("could not download from url: '%v'", url)
 	}
+	defer resp.Body.Close()
 
-	ruleFile := RuleFile{filepath, false, nil}
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("HTTP request to '%v' gave a %v status code", url, resp.StatusCode)
+	}
 
-	if err := ruleFile.Load(); err != nil {
+	ruleFile, err := writeRuleFile(directory, filename, resp.Body, "", verification.Verify)
+	if err != nil {
 		return 0, err
 	}
 
@@ -1,13 +1,159 @@
 package rules
 
 import (
+	"fmt"
+	"net"
 	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
 )
 
-// RuleSet is a set of IRule implementations.
+// minParallelChunk is the fewest rules worth handing to a goroutine when
+// matching in parallel; below this the goroutines cost more than they save.
+const minParallelChunk int = 1024
+
+// RuleSource is where a rule was loaded from.
+type RuleSource struct {
+	Path string // Path to the rule file
+	Line int    // Line number of the rule in the file, from 1
+}
+
+func (s RuleSource) String() string {
+	if s.Path == "" {
+		return "unknown source"
+	}
+
+	return fmt.Sprintf("%v:%v", s.Path, s.Line)
+}
+
+// RuleSet is a set of IRule implementations. Whitelist and blacklist rules are
+// each kept in a ruleIndex.
 type RuleSet struct {
-	rules *map[IRule]struct{}
+	rules     *map[IRule]struct{}
+	sources   map[IRule]RuleSource
+	whitelist *ruleIndex
+	blacklist *ruleIndex
+	records   map[string][]net.IP
+	workers   int
+}
+
+// NewRuleSet creates a RuleSet from a slice of rules, dropping duplicates.
+func NewRuleSet(rules []IRule) *RuleSet {
+	return newRuleSet(rules, nil)
+}
+
+// newRuleSet creates a RuleSet from a slice of rules and, if not nil, a slice
+// of where each rule came from. Where a rule is duplicated the first source is
+// kept.
+func newRuleSet(rules []IRule, sources []RuleSource) *RuleSet {
+	l := make(map[IRule]struct{}, len(rules))
+	ruleSources := make(map[IRule]RuleSource, len(sources))
+	whitelist := make([]IRule, 0)
+	blacklist := make([]IRule, 0)
+
+	for k, v := range rules {
+		if _, ok := l[v]; ok {
+			continue
+		}
+
+		l[v] = struct{}{}
+
+		if k < len(sources) {
+			ruleSources[v] = sources[k]
+		}
+
+		if v.Whitelist() {
+			whitelist = append(whitelist, v)
+		} else {
+			blacklist = append(blacklist, v)
+		}
+	}
+
+	return &RuleSet{&l, ruleSources, newRuleIndex(whitelist), newRuleIndex(blacklist), nil, 1}
+}
+
+// SetRecords sets the local records of this set, replacing any it had. A domain
+// may have several records, e.g. an ipv4 and an ipv6 address.
+func (s *RuleSet) SetRecords(records []Record) {
+	s.records = make(map[string][]net.IP, len(records))
+
+	for _, v := range records {
+		s.records[v.Domain] = append(s.records[v.Domain], v.IP)
+	}
+}
+
+// Lookup returns the addresses of the local records for a domain, or nil if it
+// has none.
+func (s *RuleSet) Lookup(domain string) []net.IP {
+	return s.records[domain]
+}
+
+// Records returns every local record in this set, sorted by domain.
+func (s *RuleSet) Records() []Record {
+	records := make([]Record, 0, len(s.records))
+
+	for domain, ips := range s.records {
+		for _, ip := range ips {
+			records = append(records, Record{domain, ip})
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Domain < records[j].Domain
+	})
+
+	return records
+}
+
+// Source returns where a rule in this set was loaded from, if that is known.
+func (s *RuleSet) Source(rule IRule) (RuleSource, bool) {
+	source, ok := s.sources[rule]
+	return source, ok
+}
+
+// SetParallel sets how many goroutines a domain is matched on. Each is given an
+// equal share of the rules that cannot be indexed (regular expressions). With 1
+// or fewer workers rules are matched one at a time.
+func (s *RuleSet) SetParallel(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	s.workers = workers
+}
+
+// Rules returns every rule in this set, in the order of the files and lines
+// they were loaded from. Rules with no known source come last, sorted by text.
+func (s *RuleSet) Rules() []IRule {
+	l := make([]IRule, 0, len(*s.rules))
+
+	for v := range *s.rules {
+		l = append(l, v)
+	}
+
+	sort.Slice(l, func(i, j int) bool {
+		a, aok := s.sources[l[i]]
+		b, bok := s.sources[l[j]]
+
+		if aok != bok {
+			return aok
+		}
+
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+
+		return l[i].String() < l[j].String()
+	})
+
+	return l
 }
 
 // Size returns the number of rules in this set.
@@ -19,25 +165,150 @@ func (s *RuleSet) Size() int {
 // should not. Whitelist rules are tested first as they always take precedence;
 // any whitelist rule that matches will provide an immediate false indication.
 // Blacklists are tested after. If there are no whitelist matches and no
-// blacklist matches then no a false indication is given.
+// blacklist matches then no a false indication is given. The domain is tested
+// as an A query; see TestQuery.
 func (s *RuleSet) Test(domain string) bool {
-	for v := range *s.rules {
-		if v.Whitelist() {
-			if v.Match(domain) {
-				return false
+	return s.TestQuery(domain, dns.TypeA)
+}
+
+// TestQuery is Test for a query of type qtype, so rules limited to other query
+// types are not matched.
+func (s *RuleSet) TestQuery(domain string, qtype uint16) bool {
+	return s.MatchQuery(domain, qtype) != nil
+}
+
+// Match returns the blacklist rule that sinkholes a given domain, following the
+// same precedence as Test. If the domain should not be sinkholed nil is
+// returned. The domain is matched as an A query; see MatchQuery.
+func (s *RuleSet) Match(domain string) IRule {
+	return s.MatchQuery(domain, dns.TypeA)
+}
+
+// MatchQuery is Match for a query of type qtype.
+func (s *RuleSet) MatchQuery(domain string, qtype uint16) IRule {
+	if s.whitelist.match(domain, qtype, s.workers) != nil {
+		return nil
+	}
+
+	return s.blacklist.match(domain, qtype, s.workers)
+}
+
+// Verdict explains the result of matching a domain against a RuleSet.
+type Verdict struct {
+	Sink             bool       // Whether the domain should be sinkholed
+	Rule             IRule      // The rule that decided the verdict, nil if no rule matched
+	Source           RuleSource // Where Rule was loaded from
+	Overridden       IRule      // A blacklist rule that Rule, a whitelist rule, overrode
+	OverriddenSource RuleSource // Where Overridden was loaded from
+}
+
+func (v Verdict) String() string {
+	if v.Rule == nil {
+		return "no rule matched"
+	}
+
+	verb := "forwarded by"
+	if v.Sink {
+		verb = "sunk by"
+	}
+
+	s := fmt.Sprintf("%v rule '%v' (%v)", verb, v.Rule, v.Source)
+
+	if v.Overridden != nil {
+		s += fmt.Sprintf(", overriding rule '%v' (%v)", v.Overridden, v.OverriddenSource)
+	}
+
+	return s
+}
+
+// Explain matches a domain as Match does, but returns which rule decided the
+// verdict and where it came from. Unlike Match, the blacklist is still checked
+// when a whitelist rule matches, to report which blacklist rule it overrode.
+func (s *RuleSet) Explain(domain string) Verdict {
+	return s.ExplainQuery(domain, dns.TypeA)
+}
+
+// ExplainQuery is Explain for a query of type qtype.
+func (s *RuleSet) ExplainQuery(domain string, qtype uint16) Verdict {
+	var v Verdict
+
+	white := s.whitelist.match(domain, qtype, s.workers)
+	black := s.blacklist.match(domain, qtype, s.workers)
+
+	if white != nil {
+		v.Rule, v.Source = white, s.sources[white]
+
+		if black != nil {
+			v.Overridden, v.OverriddenSource = black, s.sources[black]
+		}
+	} else if black != nil {
+		v.Sink = true
+		v.Rule, v.Source = black, s.sources[black]
+	}
+
+	return v
+}
+
+// matchRules returns the first rule found in rules that matches domain and
+// qtype, or nil, testing every rule in turn.
+func matchRules(rules []IRule, domain string, qtype uint16, workers int) IRule {
+	chunk := (len(rules) + workers - 1) / workers
+
+	if workers <= 1 || chunk < minParallelChunk {
+		for _, v := range rules {
+			if v.MatchType(qtype) && v.Match(domain) {
+				return v
 			}
 		}
+
+		return nil
 	}
 
-	for v := range *s.rules {
-		if !v.Whitelist() {
-			if v.Match(domain) {
-				return true
+	return matchParallel(rules, domain, qtype, chunk)
+}
+
+// matchParallel splits rules into chunks, each matched on its own goroutine.
+// Once any goroutine finds a match the others stop early. Which rule is
+// returned when several match is not defined.
+func matchParallel(rules []IRule, domain string, qtype uint16, chunk int) IRule {
+	var found int32
+	results := make(chan IRule)
+	count := 0
+
+	for i := 0; i < len(rules); i += chunk {
+		end := i + chunk
+		if end > len(rules) {
+			end = len(rules)
+		}
+
+		count++
+
+		go func(part []IRule) {
+			for _, v := range part {
+				if atomic.LoadInt32(&found) != 0 {
+					break
+				}
+
+				if v.MatchType(qtype) && v.Match(domain) {
+					atomic.StoreInt32(&found, 1)
+					results <- v
+					return
+				}
 			}
+
+			results <- nil
+		}(rules[i:end])
+	}
+
+	var match IRule
+
+	for i := 0; i < count; i++ {
+		if v := <-results; v != nil && match == nil {
+			match = v
 		}
 	}
 
-	return false
+	return match
 }
 
 func ruleToString(prefix string, str string, whitelist bool) string {
@@ -51,11 +322,13 @@ func ruleToString(prefix string, str string, whitelist bool) string {
 }
 
 // IRule is an interface for a domain matching rule. Match returns true is the
-// rule matches a given domain (case insensitive) Whitelist returns true if this
-// is a whitelist rule; false if it is a blacklist rule String returns a string
-// representation.
+// rule matches a given domain (case insensitive) MatchType returns true if the
+// rule applies to queries of a given type; rules not limited to any query
+// types apply to all of them Whitelist returns true if this is a whitelist
+// rule; false if it is a blacklist rule String returns a string representation.
 type IRule interface {
 	Match(domain string) bool
+	MatchType(qtype uint16) bool
 	Whitelist() bool
 	String() string
 }
@@ -69,6 +342,10 @@ func (r regexpRule) Match(domain string) bool {
 	return r.expression.MatchString(domain)
 }
 
+func (r regexpRule) MatchType(qtype uint16) bool {
+	return true
+}
+
 func (r regexpRule) Whitelist() bool {
 	return r.whitelist
 }
@@ -86,6 +363,10 @@ func (r containsRule) Match(domain string) bool {
 	return strings.Contains(domain, r.substring)
 }
 
+func (r containsRule) MatchType(qtype uint16) bool {
+	return true
+}
+
 func (r containsRule) Whitelist() bool {
 	return r.whitelist
 }
@@ -103,6 +384,10 @@ func (e equalsRule) Match(domain string) bool {
 	return len(domain) == len(e.str) && domain == e.str
 }
 
+func (e equalsRule) MatchType(qtype uint16) bool {
+	return true
+}
+
 func (e equalsRule) Whitelist() bool {
 	return e.whitelist
 }
@@ -110,3 +395,27 @@ func (e equalsRule) Whitelist() bool {
 func (e equalsRule) String() string {
 	return ruleToString(equalsRulePrefix, e.str, e.whitelist)
 }
+
+// suffixRule matches a domain and all of its subdomains, only on label
+// boundaries: `example.com` matches `a.b.example.com` but not `badexample.com`.
+type suffixRule struct {
+	domain    string
+	whitelist bool
+}
+
+func (r suffixRule) Match(domain string) bool {
+	l := len(domain) - len(r.domain)
+	return l >= 0 && domain[l:] == r.domain && (l == 0 || domain[l-1] == '.')
+}
+
+func (r suffixRule) MatchType(qtype uint16) bool {
+	return true
+}
+
+func (r suffixRule) Whitelist() bool {
+	return r.whitelist
+}
+
+func (r suffixRule) String() string {
+	return ruleToString(suffixRulePrefix, r.domain, r.whitelist)
+}
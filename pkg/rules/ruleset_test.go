@@ -1,15 +1,22 @@
 package rules
 
 import (
+	"fmt"
+	"io/ioutil"
+	"path"
 	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestWhitelist(t *testing.T) {
 	rule := &containsRule{"google.com", false}
 	whitelist := &containsRule{"456.google.com", true}
 
-	set := &RuleSet{&map[IRule]struct{}{rule: {}, whitelist: {}}}
+	set := NewRuleSet([]IRule{rule, whitelist})
 
 	results := [...]bool{
 		set.Test("xxx.google.com"),
@@ -85,3 +92,367 @@ func TestRuleFromString(t *testing.T) {
 		t.Fatal("no error for invalid rule")
 	}
 }
+
+func TestRuleOptions(t *testing.T) {
+	rule, err := RuleFromString("e;sink=nxdomain;example.com")
+	if err != nil {
+		t.Fatalf("error ocurred: %v", err)
+	}
+
+	if RuleOptions(rule).Sink != SinkNXDomain {
+		t.Fatalf("sink mode was not parsed, got `%v`", RuleOptions(rule).Sink)
+	}
+
+	if !rule.Match("example.com") || rule.Whitelist() {
+		t.Fatalf("rule with options does not behave as its opcode")
+	}
+
+	again, err := RuleFromString(rule.String())
+	if err != nil || again != rule {
+		t.Fatalf("rule '%v' did not parse back to itself: %v", rule, err)
+	}
+
+	if legacy, err := RuleFromString("e;X;example.com"); err != nil || RuleOptions(legacy) != (Options{}) {
+		t.Fatalf("flag field without options was not ignored: %v", err)
+	}
+
+	for _, v := range []string{"e;w,sink=nxdomain;example.com", "e;sink=bogus;example.com", "e;bogus=1;example.com"} {
+		if _, err := RuleFromString(v); err == nil {
+			t.Fatalf("no error for invalid rule '%v'", v)
+		}
+	}
+}
+
+func TestQueryTypes(t *testing.T) {
+	rule, err := RuleFromString("d;qtype=https|aaaa|AAAA;example.com")
+	if err != nil {
+		t.Fatalf("error ocurred: %v", err)
+	}
+
+	if types := RuleOptions(rule).Types; types != "AAAA|HTTPS" {
+		t.Fatalf("query types were parsed as `%v`, expected `AAAA|HTTPS`", types)
+	}
+
+	if again, err := RuleFromString(rule.String()); err != nil || again != rule {
+		t.Fatalf("rule '%v' did not parse back to itself: %v", rule, err)
+	}
+
+	anything, _ := RuleFromString("r;qtype=ANY|TYPE65534;^")
+	allowed, _ := RuleFromString("e;w,qtype=HTTPS;www.example.com")
+	set := NewRuleSet([]IRule{rule, anything, allowed})
+
+	cases := []struct {
+		domain   string
+		qtype    uint16
+		expected IRule
+	}{
+		{"www.example.com", dns.TypeAAAA, rule},
+		{"example.com", dns.TypeHTTPS, rule},
+		{"www.example.com", dns.TypeHTTPS, nil},
+		{"example.com", dns.TypeA, nil},
+		{"other.com", dns.TypeANY, anything},
+		{"other.com", 65534, anything},
+		{"other.com", dns.TypeTXT, nil},
+	}
+
+	for _, v := range cases {
+		if match := set.MatchQuery(v.domain, v.qtype); match != v.expected {
+			t.Fatalf("%v (%v) was matched by %v, expected %v", v.domain, dns.Type(v.qtype), match, v.expected)
+		}
+	}
+
+	if set.Test("example.com") {
+		t.Fatalf("Test did not match as an A query")
+	}
+
+	for _, v := range []string{"e;qtype=;example.com", "e;qtype=BOGUS;example.com", "e;qtype=TYPE0;example.com"} {
+		if _, err := RuleFromString(v); err == nil {
+			t.Fatalf("no error for invalid rule '%v'", v)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rule, _ := RuleFromString("c;sink=refused;google.com")
+	whitelist := &containsRule{"456.google.com", true}
+
+	set := NewRuleSet([]IRule{rule, whitelist})
+
+	if set.Match("xxx.google.com") != rule {
+		t.Fatalf("matching rule was not returned")
+	}
+
+	if set.Match("456.google.com") != nil {
+		t.Fatalf("whitelisted domain returned a rule")
+	}
+}
+
+// largeRuleSet creates a RuleSet of n blacklist rules, mixed between the
+// opcodes, and one whitelist rule for `whitelisted.blocked-0.example`.
+func largeRuleSet(n int) *RuleSet {
+	l := make([]IRule, 0, n+1)
+
+	for i := 0; i < n; i++ {
+		domain := "blocked-" + strconv.Itoa(i) + ".example"
+
+		switch i % 3 {
+		case 0:
+			l = append(l, equalsRule{domain, false})
+		case 1:
+			l = append(l, containsRule{domain, false})
+		default:
+			l = append(l, regexpRule{regexp.MustCompile(`^(.*\.)?` + regexp.QuoteMeta(domain) + `$`), false})
+		}
+	}
+
+	l = append(l, equalsRule{"whitelisted.blocked-0.example", true}, containsRule{"blocked-0.example", false})
+	return NewRuleSet(l)
+}
+
+func TestParallelMatch(t *testing.T) {
+	sequential := largeRuleSet(20000)
+	parallel := largeRuleSet(20000)
+	parallel.SetParallel(4)
+
+	domains := []string{
+		"blocked-0.example",
+		"blocked-19999.example",
+		"x.blocked-5.example",
+		"whitelisted.blocked-0.example",
+		"allowed.example",
+	}
+
+	for _, v := range domains {
+		if sequential.Test(v) != parallel.Test(v) {
+			t.Fatalf("parallel and sequential matching disagree on '%v'", v)
+		}
+	}
+
+	if parallel.Test("whitelisted.blocked-0.example") {
+		t.Fatalf("whitelist did not take precedence when matching in parallel")
+	}
+
+	if !parallel.Test("blocked-19999.example") {
+		t.Fatalf("rule in the last chunk did not match in parallel")
+	}
+}
+
+func benchmarkTest(b *testing.B, size int, workers int, domain string) {
+	set := largeRuleSet(size)
+	set.SetParallel(workers)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		set.Test(domain)
+	}
+}
+
+func BenchmarkTest(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		for _, workers := range []int{1, 4} {
+			name := fmt.Sprintf("rules=%v/workers=%v", size, workers)
+
+			b.Run(name+"/miss", func(b *testing.B) {
+				benchmarkTest(b, size, workers, "allowed.example")
+			})
+
+			b.Run(name+"/hit", func(b *testing.B) {
+				benchmarkTest(b, size, workers, "blocked-"+strconv.Itoa(size-1)+".example")
+			})
+		}
+	}
+}
+
+func TestAhoCorasick(t *testing.T) {
+	patterns := []string{"he", "she", "his", "hers", "s", "ersx", ""}
+	texts := []string{"ushers", "ahishers", "", "xyz", "hersx"}
+	a := newAhoCorasick(patterns)
+
+	for _, text := range texts {
+		found := make(map[int]bool)
+
+		a.match(text, func(pattern int) bool {
+			found[pattern] = true
+			return false
+		})
+
+		for k, v := range patterns {
+			if found[k] != strings.Contains(text, v) {
+				t.Fatalf("pattern '%v' in text '%v': automaton says %v", v, text, found[k])
+			}
+		}
+	}
+}
+
+func TestIndexedRuleSet(t *testing.T) {
+	l := make([]IRule, 0)
+
+	for _, v := range []string{
+		"e;;exact.example",
+		"c;;tracker",
+		"c;sink=nxdomain;tracker",
+		"r;;^ads[0-9]+\\.",
+		"e;w;tracker.allowed.example",
+		"c;w;allowed-substring",
+	} {
+		rule, err := RuleFromString(v)
+		if err != nil {
+			t.Fatalf("error ocurred: %v", err)
+		}
+
+		l = append(l, rule)
+	}
+
+	set := NewRuleSet(l)
+	cases := map[string]bool{
+		"exact.example":                       true,
+		"sub.exact.example":                   false,
+		"my-tracker.example":                  true,
+		"ads12.example":                       true,
+		"ads.example":                         false,
+		"tracker.allowed.example":             false,
+		"tracker.allowed-substring.example":   false,
+		"exact.example.allowed-substring.com": false,
+	}
+
+	for domain, expected := range cases {
+		if set.Test(domain) != expected {
+			t.Fatalf("'%v' gave %v, expected %v", domain, !expected, expected)
+		}
+	}
+
+	if set.Size() != len(l) {
+		t.Fatalf("size is %v, expected %v", set.Size(), len(l))
+	}
+}
+
+// indexedRuleSet creates a RuleSet of n blacklist rules that can all be
+// indexed, as a converted hostfile would be.
+func indexedRuleSet(n int) *RuleSet {
+	l := make([]IRule, 0, n)
+
+	for i := 0; i < n; i++ {
+		domain := "blocked-" + strconv.Itoa(i) + ".example"
+
+		if i%10 == 0 {
+			l = append(l, containsRule{"tracker-" + strconv.Itoa(i), false})
+		} else {
+			l = append(l, equalsRule{domain, false})
+		}
+	}
+
+	return NewRuleSet(l)
+}
+
+func BenchmarkIndexedTest(b *testing.B) {
+	for _, size := range []int{1000, 10000, 200000} {
+		set := indexedRuleSet(size)
+
+		for name, domain := range map[string]string{
+			"miss":     "www.allowed.example",
+			"equals":   "blocked-" + strconv.Itoa(size-1) + ".example",
+			"contains": "x.tracker-" + strconv.Itoa(size-10) + ".example",
+		} {
+			b.Run(fmt.Sprintf("rules=%v/%v", size, name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					set.Test(domain)
+				}
+			})
+		}
+	}
+}
+
+func TestSuffix(t *testing.T) {
+	rule, err := RuleFromString("d;;example.com")
+	if err != nil {
+		t.Fatalf("error ocurred: %v", err)
+	}
+
+	if _, ok := rule.(suffixRule); !ok {
+		t.Fatalf("suffix rule was not parsed as such")
+	}
+
+	if again, err := RuleFromString(rule.String()); err != nil || again != rule {
+		t.Fatalf("rule '%v' did not parse back to itself: %v", rule, err)
+	}
+
+	for domain, expected := range map[string]bool{
+		"example.com":      true,
+		"a.b.example.com":  true,
+		"badexample.com":   false,
+		"example.com.evil": false,
+		"com":              false,
+	} {
+		if rule.Match(domain) != expected {
+			t.Fatalf("rule '%v' matching '%v' gave %v, expected %v", rule, domain, !expected, expected)
+		}
+	}
+
+	whitelist, _ := RuleFromString("d;w;safe.example.com")
+	set := NewRuleSet([]IRule{rule, whitelist})
+
+	for domain, expected := range map[string]bool{
+		"a.b.example.com":     true,
+		"badexample.com":      false,
+		"safe.example.com":    false,
+		"x.safe.example.com":  false,
+		"notsafe.example.com": true,
+	} {
+		if set.Test(domain) != expected {
+			t.Fatalf("'%v' gave %v, expected %v", domain, !expected, expected)
+		}
+	}
+
+	// leading and trailing dots, as in a fully qualified name, are dropped
+	for _, text := range []string{"d;;example.com.", "d;;.example.com."} {
+		if qualified, err := RuleFromString(text); err != nil || qualified != rule || !qualified.Match("a.example.com") {
+			t.Fatalf("rule '%v' was parsed as '%v', expected '%v': %v", text, qualified, rule, err)
+		}
+	}
+
+	for _, text := range []string{"d;;", "d;;."} {
+		if _, err := RuleFromString(text); err == nil {
+			t.Fatalf("no error for empty suffix rule '%v'", text)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"block": "# blocking rules\nd;;example.com\nc;;tracker\n",
+		"allow": "# allowed\n# still allowed\ne;w;safe.example.com\n",
+	}
+
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("could not write rule file: %v", err)
+		}
+	}
+
+	loaded, err := LoadAllRuleFiles(dir, LoadStrict)
+	if err != nil {
+		t.Fatalf("could not load rule files: %v", err)
+	}
+
+	set := CollectAllRules(loaded)
+
+	v := set.Explain("a.example.com")
+	if !v.Sink || v.Rule.String() != "d;;example.com" || v.Source != (RuleSource{path.Join(dir, "block"), 2}) {
+		t.Fatalf("unexpected verdict for sunk domain: %v", v)
+	}
+
+	v = set.Explain("safe.example.com")
+	if v.Sink || v.Rule.String() != "e;w;safe.example.com" || v.Source.Line != 3 {
+		t.Fatalf("unexpected verdict for whitelisted domain: %v", v)
+	}
+
+	if v.Overridden == nil || v.Overridden.String() != "d;;example.com" || v.OverriddenSource.Line != 2 {
+		t.Fatalf("overridden blacklist rule was not reported: %v", v)
+	}
+
+	v = set.Explain("other.test")
+	if v.Sink || v.Rule != nil || v.Overridden != nil {
+		t.Fatalf("unexpected verdict for unmatched domain: %v", v)
+	}
+}
@@ -0,0 +1,128 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultSubscriptionInterval is how often a subscription is updated if no
+// interval is given.
+const DefaultSubscriptionInterval time.Duration = 24 * time.Hour
+
+// minSubscriptionInterval stops a list being downloaded more often than is
+// polite to whoever hosts it.
+const minSubscriptionInterval time.Duration = time.Minute
+
+// Subscription is a rule list that is downloaded from a URL into the rules
+// directory, and downloaded again every Interval.
+type Subscription struct {
+	Name     string
+	URL      string
+	Format   Format // Empty to detect the format as usual
+	Interval time.Duration
+
+	etag         string
+	lastModified string
+}
+
+// NewSubscription creates a Subscription from its configuration, checking the
+// name can be used as a file name and the URL and format are valid.
+func NewSubscription(name string, rawurl string, format string, interval time.Duration) (*Subscription, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("subscription name '%v' cannot be used as a file name", name)
+	}
+
+	u, err := url.ParseRequestURI(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("subscription '%v' has an invalid url '%v'", name, rawurl)
+	}
+
+	s := &Subscription{Name: name, URL: u.String(), Interval: interval}
+
+	if format != "" {
+		if s.Format, err = ParseFormat(format); err != nil {
+			return nil, fmt.Errorf("subscription '%v': %v", name, err)
+		}
+	}
+
+	if s.Interval == 0 {
+		s.Interval = DefaultSubscriptionInterval
+	} else if s.Interval < minSubscriptionInterval {
+		return nil, fmt.Errorf("subscription '%v' has an interval shorter than %v", name, minSubscriptionInterval)
+	}
+
+	return s, nil
+}
+
+// Filename is the name of the file the list is kept in. The extension gives
+// the format, if one was set.
+func (s *Subscription) Filename() string {
+	if s.Format == "" || s.Format == FormatDNSFSD {
+		return s.Name
+	}
+
+	return s.Name + "." + string(s.Format)
+}
+
+// Update downloads the list into directory if it has changed since it was last
+// downloaded, and returns whether it did. The previous download's ETag and
+// Last-Modified headers are sent so an unchanged list is not downloaded again;
+// until the list has been downloaded once, the time the file in directory was
+// last modified is used instead. If the new list cannot be loaded the
+// previous one is kept and an error is returned.
+func (s *Subscription) Update(client *http.Client, directory string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	filepath := path.Join(directory, s.Filename())
+	lastModified := s.lastModified
+
+	if lastModified == "" {
+		if info, err := os.Stat(filepath); err == nil {
+			lastModified = info.ModTime().UTC().Format(http.TimeFormat)
+		}
+	}
+
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("could not download subscription '%v' from url: '%v'", s.Name, s.URL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HTTP request to '%v' gave a %v status code", s.URL, resp.StatusCode)
+	}
+
+	if _, err := writeRuleFile(directory, s.Filename(), resp.Body, s.Format, nil); err != nil {
+		return false, fmt.Errorf("subscription '%v' not updated: %v", s.Name, err)
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+
+	// so that the file's time can stand in for Last-Modified after a restart
+	if t, err := http.ParseTime(s.lastModified); err == nil {
+		_ = os.Chtimes(filepath, t, t)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,127 @@
+package rules
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionUpdate(t *testing.T) {
+	body := "||ads.example.com^\n"
+	modified := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	requests := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		if r.Header.Get("If-None-Match") == `"v1"` && body == "||ads.example.com^\n" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", modified)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	directory := t.TempDir()
+	s, err := NewSubscription("ads", srv.URL, "adblock", time.Hour)
+	if err != nil {
+		t.Fatalf("could not create subscription: %v", err)
+	}
+
+	if updated, err := s.Update(srv.Client(), directory); err != nil || !updated {
+		t.Fatalf("first update gave %v, %v", updated, err)
+	}
+
+	filepath := path.Join(directory, "ads.adblock")
+	if data, err := ioutil.ReadFile(filepath); err != nil || string(data) != body {
+		t.Fatalf("list was not written: '%s' %v", data, err)
+	}
+
+	if updated, err := s.Update(srv.Client(), directory); err != nil || updated {
+		t.Fatalf("unchanged list gave %v, %v", updated, err)
+	}
+
+	// a list that cannot be loaded keeps the old one
+	body = "<html>not found</html>\n"
+
+	if updated, err := s.Update(srv.Client(), directory); err == nil || updated {
+		t.Fatalf("unloadable list gave %v, %v", updated, err)
+	}
+
+	if data, _ := ioutil.ReadFile(filepath); string(data) != "||ads.example.com^\n" {
+		t.Fatalf("old list was replaced with '%s'", data)
+	}
+
+	if files, _ := ioutil.ReadDir(directory); len(files) != 1 {
+		t.Fatalf("temporary files were left behind: %v", files)
+	}
+
+	if requests != 3 {
+		t.Fatalf("%v requests were made, expected 3", requests)
+	}
+}
+
+func TestSubscriptionIfModifiedSince(t *testing.T) {
+	modified := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		_, _ = w.Write([]byte("0.0.0.0 ads.example.com\n"))
+	}))
+	defer srv.Close()
+
+	directory := t.TempDir()
+	s, _ := NewSubscription("hosts", srv.URL, "", 0)
+
+	if updated, err := s.Update(srv.Client(), directory); err != nil || !updated {
+		t.Fatalf("first update gave %v, %v", updated, err)
+	}
+
+	// as after a restart, only the file's modification time is known
+	s, _ = NewSubscription("hosts", srv.URL, "", 0)
+
+	if updated, err := s.Update(srv.Client(), directory); err != nil || updated {
+		t.Fatalf("unchanged list gave %v, %v", updated, err)
+	}
+
+	files, err := LoadAllRuleFiles(directory, LoadLenient)
+	if err != nil || len(*files) != 1 || (*files)[0].Format != FormatHosts {
+		t.Fatalf("subscription did not load as a hosts file: %v", err)
+	}
+}
+
+func TestNewSubscriptionInvalid(t *testing.T) {
+	cases := []struct {
+		name, url, format string
+		interval          time.Duration
+	}{
+		{"", "https://example.com/list", "", 0},
+		{"../escape", "https://example.com/list", "", 0},
+		{".hidden", "https://example.com/list", "", 0},
+		{"list", "example.com/list", "", 0},
+		{"list", "ftp://example.com/list", "", 0},
+		{"list", "https://example.com/list", "nonsense", 0},
+		{"list", "https://example.com/list", "", time.Second},
+	}
+
+	for _, v := range cases {
+		if _, err := NewSubscription(v.name, v.url, v.format, v.interval); err == nil {
+			t.Fatalf("no error for subscription %v", v)
+		}
+	}
+
+	if s, err := NewSubscription("list", "https://example.com/list", "", 0); err != nil || s.Interval != DefaultSubscriptionInterval {
+		t.Fatalf("default interval not used: %v %v", s, err)
+	}
+}
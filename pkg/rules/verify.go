@@ -0,0 +1,163 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	minisignPureAlgorithm   string = "Ed" // signs the file itself
+	minisignHashedAlgorithm string = "ED" // signs the BLAKE2b-512 hash of the file
+	minisignKeyIDSize       int    = 8
+)
+
+// Verification is how a downloaded rule file is checked before it is used.
+// The zero Verification checks nothing.
+type Verification struct {
+	SHA256    string // Hex SHA-256 sum the file must have, if not empty
+	PublicKey string // Base64 ed25519 or minisign public key the file must be signed with, if not empty
+	Signature []byte // The signature: base64 ed25519, or the contents of a minisign .minisig file
+}
+
+// Empty returns whether the Verification checks nothing.
+func (v Verification) Empty() bool {
+	return v.SHA256 == "" && v.PublicKey == ""
+}
+
+// Verify checks the file at filepath against the sum and signature.
+func (v Verification) Verify(filepath string) error {
+	if v.SHA256 != "" {
+		if err := verifySHA256(filepath, v.SHA256); err != nil {
+			return err
+		}
+	}
+
+	if v.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v.PublicKey))
+		if err != nil {
+			return errors.New("public key is not valid base64")
+		}
+
+		switch len(key) {
+		case ed25519.PublicKeySize:
+			return verifyEd25519(filepath, ed25519.PublicKey(key), v.Signature)
+		case 2 + minisignKeyIDSize + ed25519.PublicKeySize:
+			return verifyMinisign(filepath, key, v.Signature)
+		default:
+			return errors.New("public key is neither an ed25519 nor a minisign key")
+		}
+	}
+
+	return nil
+}
+
+func verifySHA256(filepath string, sum string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, strings.TrimSpace(sum)) {
+		return fmt.Errorf("SHA-256 sum %v does not match the expected %v", actual, sum)
+	}
+
+	return nil
+}
+
+func verifyEd25519(filepath string, key ed25519.PublicKey, signature []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("signature is not a base64 ed25519 signature")
+	}
+
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(key, data, sig) {
+		return errors.New("ed25519 signature does not match")
+	}
+
+	return nil
+}
+
+// verifyMinisign checks a minisign signature, which is made of an untrusted
+// comment, the signature of the file, a trusted comment and a global signature
+// of the file's signature and the trusted comment.
+func verifyMinisign(filepath string, key []byte, signature []byte) error {
+	lines := make([]string, 0, 4)
+	scanner := bufio.NewScanner(bytes.NewReader(signature))
+
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("signature is not a minisign signature")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+minisignKeyIDSize+ed25519.SignatureSize {
+		return errors.New("minisign signature is invalid")
+	}
+
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("minisign global signature is invalid")
+	}
+
+	if string(key[:2]) != minisignPureAlgorithm {
+		return errors.New("minisign public key uses an unknown algorithm")
+	}
+
+	if !bytes.Equal(key[2:2+minisignKeyIDSize], sig[2:2+minisignKeyIDSize]) {
+		return errors.New("minisign signature was made with a different key")
+	}
+
+	publicKey := ed25519.PublicKey(key[2+minisignKeyIDSize:])
+	fileSig := sig[2+minisignKeyIDSize:]
+
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+
+	switch string(sig[:2]) {
+	case minisignPureAlgorithm:
+	case minisignHashedAlgorithm:
+		sum := blake2b.Sum512(data)
+		data = sum[:]
+	default:
+		return errors.New("minisign signature uses an unknown algorithm")
+	}
+
+	if !ed25519.Verify(publicKey, data, fileSig) {
+		return errors.New("minisign signature does not match")
+	}
+
+	trusted := append(append([]byte{}, fileSig...), strings.TrimPrefix(lines[2], "trusted comment: ")...)
+	if !ed25519.Verify(publicKey, trusted, global) {
+		return errors.New("minisign trusted comment signature does not match")
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package rules
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign creates a minisign public key and a signature of data with it, as
+// the minisign tool would.
+func minisign(t *testing.T, data []byte, algorithm string) (string, []byte) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	keyID := []byte("12345678")
+	signed := data
+
+	if algorithm == minisignHashedAlgorithm {
+		sum := blake2b.Sum512(data)
+		signed = sum[:]
+	}
+
+	sig := ed25519.Sign(private, signed)
+	comment := "timestamp:1614600000\tfile:list"
+	global := ed25519.Sign(private, append(append([]byte{}, sig...), comment...))
+
+	key := append(append([]byte(minisignPureAlgorithm), keyID...), public...)
+	signature := fmt.Sprintf("untrusted comment: signature from minisign secret key\n%v\ntrusted comment: %v\n%v\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), keyID...), sig...)),
+		comment,
+		base64.StdEncoding.EncodeToString(global))
+
+	return base64.StdEncoding.EncodeToString(key), []byte(signature)
+}
+
+func TestVerify(t *testing.T) {
+	data := []byte("e;;ads.example.com\n")
+	filepath := path.Join(t.TempDir(), "list")
+
+	if err := ioutil.WriteFile(filepath, data, 0644); err != nil {
+		t.Fatalf("could not write rule file: %v", err)
+	}
+
+	sum := sha256.Sum256(data)
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	ed25519Key := base64.StdEncoding.EncodeToString(public)
+	ed25519Sig := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, data)))
+	pureKey, pureSig := minisign(t, data, minisignPureAlgorithm)
+	hashedKey, hashedSig := minisign(t, data, minisignHashedAlgorithm)
+
+	valid := []Verification{
+		{},
+		{SHA256: hex.EncodeToString(sum[:])},
+		{PublicKey: ed25519Key, Signature: ed25519Sig},
+		{PublicKey: pureKey, Signature: pureSig},
+		{SHA256: hex.EncodeToString(sum[:]), PublicKey: hashedKey, Signature: hashedSig},
+	}
+
+	for k, v := range valid {
+		if err := v.Verify(filepath); err != nil {
+			t.Fatalf("valid verification %v failed: %v", k, err)
+		}
+	}
+
+	invalid := []Verification{
+		{SHA256: hex.EncodeToString(make([]byte, sha256.Size))},
+		{PublicKey: ed25519Key, Signature: pureSig},
+		{PublicKey: pureKey, Signature: hashedSig},
+		{PublicKey: hashedKey, Signature: []byte("not a signature")},
+		{PublicKey: "not a key", Signature: ed25519Sig},
+		{PublicKey: ed25519Key},
+	}
+
+	for k, v := range invalid {
+		if err := v.Verify(filepath); err == nil {
+			t.Fatalf("no error for invalid verification %v", k)
+		}
+	}
+}
+
+func TestDownloadRuleFile(t *testing.T) {
+	body := "e;;ads.example.com\n"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	directory := t.TempDir()
+	sum := sha256.Sum256([]byte(body))
+	verification := Verification{SHA256: hex.EncodeToString(sum[:])}
+
+	if n, err := downloadRuleFile(srv.Client(), srv.URL, directory, "list", verification); err != nil || n != 1 {
+		t.Fatalf("download gave %v rules, %v", n, err)
+	}
+
+	// a tampered list, and one truncated mid rule, are never put in place
+	for _, v := range []string{"e;;ads.example.com\ne;;good.example.com\n", "e;;ads.example.com\nr;;^ad[0-9"} {
+		body = v
+
+		if _, err := downloadRuleFile(srv.Client(), srv.URL, directory, "list", verification); err == nil {
+			t.Fatalf("no error downloading '%v'", v)
+		}
+
+		if data, _ := ioutil.ReadFile(path.Join(directory, "list")); string(data) != "e;;ads.example.com\n" {
+			t.Fatalf("list was replaced with '%s'", data)
+		}
+	}
+
+	if _, err := downloadRuleFile(srv.Client(), srv.URL, directory, "list", Verification{}); err == nil {
+		t.Fatalf("no error downloading a list that does not load")
+	}
+
+	if files, _ := ioutil.ReadDir(directory); len(files) != 1 {
+		t.Fatalf("temporary files were left behind: %v", files)
+	}
+}